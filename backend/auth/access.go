@@ -26,6 +26,20 @@ func JWTAuth(c echo.Context) (*uint64, error) {
 	return extractUserIDFromClaims(c, token.Claims)
 }
 
+// JWT: Context からトークンのIDを取得
+// トークンのIDには発行元のリフレッシュトークンのファミリーが入っている
+func JWTTokenID(c echo.Context) string {
+	token, ok := c.Get("user").(*jwt.Token)
+	if !ok {
+		return ""
+	}
+	claims, ok := token.Claims.(*jwtCustomClaims)
+	if !ok {
+		return ""
+	}
+	return claims.ID
+}
+
 // JWT: トークンとシークレットからユーザーIDを取得
 func JWTTokenAuth(c echo.Context, tokenStr, jwtSecret string) (*uint64, error) {
 	token, err := jwt.ParseWithClaims(tokenStr, &jwtCustomClaims{}, func(t *jwt.Token) (interface{}, error) {
@@ -1,13 +1,92 @@
 package auth
 
-/*
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/model"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidAPIKey はAPIキーが不正・失効・期限切れであることを表す
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// ErrUnknownScope は存在しないスコープが指定されたことを表す
+var ErrUnknownScope = errors.New("unknown scope")
+
 const (
 	MinAccessTokenLength = 64
 	MinSecretTokenLength = 72
 )
 
+// APIトークンのスコープ
+const (
+	ScopeRead    = "read"    // 参照系のAPI
+	ScopePower   = "power"   // 電源操作
+	ScopeConsole = "console" // コンソール接続用チケットの発行
+)
+
+// Scopes は指定できるスコープの一覧
+var Scopes = []string{ScopeRead, ScopePower, ScopeConsole}
+
+// apiTokenContextKey はAPIキーで認証したトークンを保存するコンテキストのキー
+const apiTokenContextKey = "apiToken"
+
+// CreateAPIToken はAPIトークンを作成し、作成したトークンと一度だけ表示するシークレットを返す
+// scopes を省略した場合は全てのスコープを持つ
+func CreateAPIToken(db *gorm.DB, userID uint64, name string, scopes []string, expiresAt *time.Time) (*model.APIToken, string, error) {
+	if len(scopes) == 0 {
+		scopes = Scopes
+	}
+	for _, s := range scopes {
+		if !slices.Contains(Scopes, s) {
+			return nil, "", fmt.Errorf("%w: %s", ErrUnknownScope, s)
+		}
+	}
+
+	// 48バイト → 64文字、54バイト → 72文字 (bcryptが扱える最大長)
+	accessToken, err := generateSecureToken(48)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := generateSecureToken(54)
+	if err != nil {
+		return nil, "", err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token := &model.APIToken{
+		UserID:      userID,
+		Name:        name,
+		AccessToken: accessToken,
+		SecretToken: string(hash),
+		Scopes:      strings.Join(scopes, " "),
+		ExpiresAt:   expiresAt,
+	}
+	if err := db.Create(token).Error; err != nil {
+		return nil, "", err
+	}
+	return token, secret, nil
+}
+
+// IsAPIKeyRequest は Authorization ヘッダがAPIキーかを返す
+func IsAPIKeyRequest(c echo.Context) bool {
+	scheme, _, _ := strings.Cut(c.Request().Header.Get(echo.HeaderAuthorization), " ")
+	return strings.EqualFold(scheme, "apikey")
+}
+
 // APIキー認証: ヘッダーから認証情報取得・検証
-func APIKeyAuth(c echo.Context, db *gorm.DB) (*uint64, error) {
+// 認証に成功した場合はトークンをコンテキストに保存する
+func APIKeyAuth(c echo.Context, db *gorm.DB) (*model.APIToken, error) {
 	accessToken, secretToken, err := parseAPIKeyHeader(c)
 	if err != nil {
 		return nil, err
@@ -16,44 +95,82 @@ func APIKeyAuth(c echo.Context, db *gorm.DB) (*uint64, error) {
 	// APIトークン取得
 	apiToken := &model.APIToken{}
 	if err := db.Where("access_token = ?", accessToken).First(apiToken).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, unauthorized(c)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrInvalidAPIKey
 		}
-		return nil, errorMessage(c, "Database error: "+err.Error())
+		return nil, err
+	}
+	if apiToken.ExpiresAt != nil && apiToken.ExpiresAt.Before(time.Now()) {
+		return nil, ErrInvalidAPIKey
 	}
 
 	// シークレットトークン検証
 	if err := bcrypt.CompareHashAndPassword([]byte(apiToken.SecretToken), []byte(secretToken)); err != nil {
-		return nil, unauthorized(c)
+		return nil, ErrInvalidAPIKey
 	}
 
-	// ユーザー取得
-	user := &model.User{}
-	if err := db.Where("api_token_id = ?", apiToken.ID).First(user).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return nil, unauthorized(c)
-		}
-		return nil, errorMessage(c, "Database error: "+err.Error())
-	}
+	// 最終使用日時を記録する (失敗しても認証は通す)
+	now := time.Now()
+	db.Model(apiToken).UpdateColumn("last_used_at", now)
+	apiToken.LastUsedAt = &now
 
-	return &user.ID, nil
+	c.Set(apiTokenContextKey, apiToken)
+	return apiToken, nil
 }
 
 func parseAPIKeyHeader(c echo.Context) (string, string, error) {
-	authHeader := c.Request().Header.Get("Authorization")
+	authHeader := c.Request().Header.Get(echo.HeaderAuthorization)
 	if authHeader == "" {
-		return "", "", unauthorized(c)
+		return "", "", ErrInvalidAPIKey
 	}
 
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || strings.ToLower(parts[0]) != "apikey" {
-		return "", "", unauthorized(c)
+		return "", "", ErrInvalidAPIKey
 	}
 
 	tokens := strings.SplitN(parts[1], ":", 2)
 	if len(tokens) != 2 || len(tokens[0]) < MinAccessTokenLength || len(tokens[1]) < MinSecretTokenLength {
-		return "", "", unauthorized(c)
+		return "", "", ErrInvalidAPIKey
 	}
 	return tokens[0], tokens[1], nil
 }
-*/
+
+// APITokenFromContext はAPIキーで認証した場合にそのトークンを返す
+// JWTで認証した場合は nil を返す
+func APITokenFromContext(c echo.Context) *model.APIToken {
+	token, _ := c.Get(apiTokenContextKey).(*model.APIToken)
+	return token
+}
+
+// UserID はJWTまたはAPIキーで認証したユーザーIDを返す
+func UserID(c echo.Context) (*uint64, error) {
+	if token := APITokenFromContext(c); token != nil {
+		return &token.UserID, nil
+	}
+	return JWTAuth(c)
+}
+
+// TokenID は認証に使ったトークンの識別子を返す
+// JWTの場合は発行元のリフレッシュトークンのファミリー、APIキーの場合は "apitoken:<ID>"
+func TokenID(c echo.Context) string {
+	if token := APITokenFromContext(c); token != nil {
+		return APITokenSessionID(token.ID)
+	}
+	return JWTTokenID(c)
+}
+
+// APITokenSessionID はAPIトークンで開始したセッションに記録する識別子を返す
+func APITokenSessionID(id uint64) string {
+	return "apitoken:" + strconv.FormatUint(id, 10)
+}
+
+// TokenScopes はトークンのスコープの一覧を返す
+func TokenScopes(t *model.APIToken) []string {
+	return strings.Fields(t.Scopes)
+}
+
+// HasScope はトークンがスコープを持つかを返す
+func HasScope(t *model.APIToken, scope string) bool {
+	return slices.Contains(TokenScopes(t), scope)
+}
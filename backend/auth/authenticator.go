@@ -0,0 +1,62 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"github.com/masa23/webapp-test/model"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidCredentials はユーザ名またはパスワードが正しくないことを表す
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+// AccessDeniedError は認証には成功したがログインを許可しないことを表す
+// (外部の認証基盤のグループがどの組織にも対応しない場合など)
+type AccessDeniedError string
+
+func (e AccessDeniedError) Error() string { return string(e) }
+
+// Authenticator はユーザ名とパスワードを確認し、対応するユーザを返す
+// 認証できない場合は ErrInvalidCredentials を返す
+type Authenticator interface {
+	Authenticate(ctx context.Context, db *gorm.DB, username, password string) (*model.User, error)
+}
+
+// Authenticators は複数の認証方式を順に試す
+// いずれかで認証できればそのユーザを返し、全て ErrInvalidCredentials であれば ErrInvalidCredentials を返す
+type Authenticators []Authenticator
+
+func (a Authenticators) Authenticate(ctx context.Context, db *gorm.DB, username, password string) (*model.User, error) {
+	var firstErr error
+	for _, authenticator := range a {
+		user, err := authenticator.Authenticate(ctx, db, username, password)
+		if err == nil {
+			return user, nil
+		}
+		// 外部の認証基盤に接続できない場合なども残りの認証方式は試す
+		if !errors.Is(err, ErrInvalidCredentials) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, ErrInvalidCredentials
+}
+
+// LocalAuthenticator はDBに保存したbcryptのパスワードで認証する
+// パスワードが設定されていないユーザ (OIDC・LDAPで作成したユーザ) は認証しない
+type LocalAuthenticator struct{}
+
+func (LocalAuthenticator) Authenticate(ctx context.Context, db *gorm.DB, username, password string) (*model.User, error) {
+	user, err := findUserByUsername(db.WithContext(ctx), username)
+	if err != nil || user.Password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
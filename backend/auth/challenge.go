@@ -0,0 +1,98 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInvalidChallenge はチャレンジが存在しない・期限切れ・試行回数超過であることを表す
+var ErrInvalidChallenge = errors.New("invalid or expired challenge")
+
+// maxChallengeAttempts は1つのチャレンジでコードを試せる回数
+const maxChallengeAttempts = 5
+
+// LoginChallenge はパスワード認証に成功したユーザに発行する二段階認証用のチャレンジ
+// 二段階目のコードを確認するまでリフレッシュトークンは発行しない
+type LoginChallenge struct {
+	UserID    uint64
+	ExpiresAt time.Time
+	// Enrollment が true の場合は組織の設定で二段階認証が必須だが未登録のため、
+	// ログイン中に登録させる
+	Enrollment bool
+
+	attempts int
+}
+
+// ChallengeStore はログインのチャレンジをメモリ上で管理する
+type ChallengeStore struct {
+	ttl time.Duration
+
+	mu         sync.Mutex
+	challenges map[string]*LoginChallenge
+}
+
+func NewChallengeStore(ttl time.Duration) *ChallengeStore {
+	return &ChallengeStore{ttl: ttl, challenges: make(map[string]*LoginChallenge)}
+}
+
+// Issue はユーザのチャレンジを発行する
+func (s *ChallengeStore) Issue(userID uint64, enrollment bool) (string, time.Time, error) {
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(s.ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 期限切れのチャレンジを掃除する
+	now := time.Now()
+	for k, ch := range s.challenges {
+		if now.After(ch.ExpiresAt) {
+			delete(s.challenges, k)
+		}
+	}
+
+	s.challenges[token] = &LoginChallenge{UserID: userID, ExpiresAt: expiresAt, Enrollment: enrollment}
+	return token, expiresAt, nil
+}
+
+// Attempt はコードを確認する前に呼び出し、チャレンジを返す
+// 試行回数を超えたチャレンジは無効になる
+func (s *ChallengeStore) Attempt(token string) (LoginChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.challenges[token]
+	if !ok || time.Now().After(ch.ExpiresAt) {
+		delete(s.challenges, token)
+		return LoginChallenge{}, ErrInvalidChallenge
+	}
+	ch.attempts++
+	if ch.attempts > maxChallengeAttempts {
+		delete(s.challenges, token)
+		return LoginChallenge{}, ErrInvalidChallenge
+	}
+	return *ch, nil
+}
+
+// Peek はチャレンジを試行回数を数えずに返す
+func (s *ChallengeStore) Peek(token string) (LoginChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch, ok := s.challenges[token]
+	if !ok || time.Now().After(ch.ExpiresAt) {
+		return LoginChallenge{}, ErrInvalidChallenge
+	}
+	return *ch, nil
+}
+
+// Complete は二段階認証に成功したチャレンジを無効化する
+func (s *ChallengeStore) Complete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.challenges, token)
+}
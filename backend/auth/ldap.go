@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// LDAPConfig はLDAP・Active Directoryで認証するための設定
+type LDAPConfig struct {
+	URL            string      // ldap://host:389 または ldaps://host:636
+	StartTLS       bool        // ldap:// で接続した後にStartTLSする
+	TLSConfig      *tls.Config // ldaps:// とStartTLSで使うTLSの設定
+	BindDN         string      // ユーザを検索するためのアカウント (空の場合は匿名で検索する)
+	BindPassword   string
+	BaseDN         string        // ユーザを検索する起点
+	UserFilter     string        // ユーザを検索するフィルタ (%s はエスケープしたユーザ名に置き換える)
+	GroupAttribute string        // ユーザが所属するグループの属性 (memberOf など)
+	Timeout        time.Duration // 接続と各操作のタイムアウト
+}
+
+// LDAPProvisionFunc はLDAPで認証されたユーザに対応するユーザを返す
+// dn は認証したエントリのDN
+// ユーザが存在しない場合は作成し、グループに従って組織と役割を同期する
+type LDAPProvisionFunc func(ctx context.Context, db *gorm.DB, dn, username string, groups []string) (*model.User, error)
+
+// LDAPAuthenticator はユーザを検索してそのDNでバインドすることでパスワードを確認する
+type LDAPAuthenticator struct {
+	Config    LDAPConfig
+	Provision LDAPProvisionFunc
+}
+
+func (a *LDAPAuthenticator) Authenticate(ctx context.Context, db *gorm.DB, username, password string) (*model.User, error) {
+	// パスワードが空のバインドは匿名バインドとして成功するサーバがあるため拒否する
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := a.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if a.Config.BindDN != "" {
+		if err := conn.Bind(a.Config.BindDN, a.Config.BindPassword); err != nil {
+			return nil, fmt.Errorf("LDAP bind failed: %w", err)
+		}
+	}
+
+	// 2件以上見つかった場合はどのユーザか決められないため認証しない
+	res, err := conn.Search(ldap.NewSearchRequest(
+		a.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(a.Config.Timeout.Seconds()), false,
+		fmt.Sprintf(a.Config.UserFilter, ldap.EscapeFilter(username)),
+		[]string{a.Config.GroupAttribute}, nil,
+	))
+	if err != nil && !ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("LDAP search failed: %w", err)
+	}
+	if res == nil || len(res.Entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, fmt.Errorf("LDAP bind failed: %w", err)
+	}
+
+	if a.Provision == nil {
+		return nil, errors.New("LDAP provisioning is not configured")
+	}
+	return a.Provision(ctx, db, entry.DN, username, entry.GetAttributeValues(a.Config.GroupAttribute))
+}
+
+func (a *LDAPAuthenticator) dial(ctx context.Context) (*ldap.Conn, error) {
+	dialer := &net.Dialer{Timeout: a.Config.Timeout}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	conn, err := ldap.DialURL(a.Config.URL, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(a.Config.TLSConfig))
+	if err != nil {
+		return nil, fmt.Errorf("LDAP connection failed: %w", err)
+	}
+	conn.SetTimeout(a.Config.Timeout)
+	if a.Config.StartTLS {
+		if err := conn.StartTLS(a.Config.TLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %w", err)
+		}
+	}
+	return conn, nil
+}
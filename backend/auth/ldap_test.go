@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/masa23/webapp-test/auth/ldaptest"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+func TestLDAPAuthenticator(t *testing.T) {
+	fake, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fake.Close()
+	fake.AddEntry(ldaptest.Entry{DN: "cn=svc,dc=example,dc=com", Password: "svc-secret"})
+	fake.AddEntry(ldaptest.Entry{
+		DN:       "uid=carol,ou=people,dc=example,dc=com",
+		Password: "carol-secret",
+		Attributes: map[string][]string{
+			"objectClass": {"person"},
+			"uid":         {"carol"},
+			"memberOf":    {"cn=infra,ou=groups,dc=example,dc=com", "cn=dev,ou=groups,dc=example,dc=com"},
+		},
+	})
+	// objectClass が一致しないため検索されない
+	fake.AddEntry(ldaptest.Entry{
+		DN:         "uid=printer,ou=devices,dc=example,dc=com",
+		Password:   "printer-secret",
+		Attributes: map[string][]string{"objectClass": {"device"}, "uid": {"printer"}},
+	})
+
+	var provisioned []string
+	a := &LDAPAuthenticator{
+		Config: LDAPConfig{
+			URL:            fake.URL(),
+			BindDN:         "cn=svc,dc=example,dc=com",
+			BindPassword:   "svc-secret",
+			BaseDN:         "dc=example,dc=com",
+			UserFilter:     "(&(objectClass=person)(uid=%s))",
+			GroupAttribute: "memberOf",
+			Timeout:        time.Second,
+		},
+		Provision: func(ctx context.Context, db *gorm.DB, dn, username string, groups []string) (*model.User, error) {
+			if dn != "uid=carol,ou=people,dc=example,dc=com" {
+				t.Errorf("dn = %q", dn)
+			}
+			provisioned = groups
+			return &model.User{Username: username}, nil
+		},
+	}
+
+	user, err := a.Authenticate(context.Background(), nil, "carol", "carol-secret")
+	if err != nil || user.Username != "carol" {
+		t.Fatalf("Authenticate = %+v, %v", user, err)
+	}
+	if len(provisioned) != 2 || provisioned[0] != "cn=infra,ou=groups,dc=example,dc=com" {
+		t.Errorf("groups = %v", provisioned)
+	}
+	if binds := fake.Binds(); !slices.Equal(binds, []string{"cn=svc,dc=example,dc=com", "uid=carol,ou=people,dc=example,dc=com"}) {
+		t.Errorf("binds = %v", binds)
+	}
+
+	for _, tc := range []struct{ username, password string }{
+		{"carol", "wrong"},
+		{"carol", ""},
+		{"dave", "carol-secret"},
+		{"printer", "printer-secret"},
+		{"*", "carol-secret"}, // フィルタの特殊文字はエスケープされる
+	} {
+		if _, err := a.Authenticate(context.Background(), nil, tc.username, tc.password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Authenticate(%q, %q) = %v, want ErrInvalidCredentials", tc.username, tc.password, err)
+		}
+	}
+
+	// 検索用のアカウントでバインドできない場合は設定の誤りとしてエラーにする
+	bad := *a
+	bad.Config.BindPassword = "wrong"
+	if _, err := bad.Authenticate(context.Background(), nil, "carol", "carol-secret"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("bad service account: %v", err)
+	}
+
+	// 接続できないLDAPサーバがあっても、他の認証方式で認証できればよい
+	fake.Close()
+	chain := Authenticators{a, stubAuthenticator{"erin"}}
+	if user, err := chain.Authenticate(context.Background(), nil, "erin", "password"); err != nil || user.Username != "erin" {
+		t.Errorf("chain = %+v, %v", user, err)
+	}
+	if _, err := chain.Authenticate(context.Background(), nil, "carol", "carol-secret"); err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("chain with unavailable LDAP: %v", err)
+	}
+}
+
+// stubAuthenticator は決まったユーザのみ認証する
+type stubAuthenticator struct {
+	username string
+}
+
+func (s stubAuthenticator) Authenticate(ctx context.Context, db *gorm.DB, username, password string) (*model.User, error) {
+	if username != s.username {
+		return nil, ErrInvalidCredentials
+	}
+	return &model.User{Username: username}, nil
+}
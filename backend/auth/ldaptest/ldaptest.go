@@ -0,0 +1,228 @@
+// Package ldaptest はLDAPの認証をテストするためのインメモリなLDAPサーバを提供する
+package ldaptest
+
+import (
+	"net"
+	"strings"
+	"sync"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Entry はLDAPサーバのエントリ
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server はテスト用のインメモリなLDAPサーバ
+// 単純バインドと、AND・OR・NOT・等価・存在のフィルタによる検索のみに対応する
+type Server struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries []Entry
+	binds   []string
+	wg      sync.WaitGroup
+}
+
+// NewServer はループバックアドレスでLDAPサーバを起動する
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	f := &Server{listener: l}
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+// URL は接続先のURLを返す
+func (f *Server) URL() string {
+	return "ldap://" + f.listener.Addr().String()
+}
+
+// AddEntry はエントリを登録する
+// Password が空のエントリにはバインドできない
+func (f *Server) AddEntry(entry Entry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = append(f.entries, entry)
+}
+
+// Binds は成功したバインドのDNを順に返す
+func (f *Server) Binds() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.binds...)
+}
+
+// Close はサーバを停止する
+func (f *Server) Close() error {
+	err := f.listener.Close()
+	f.wg.Wait()
+	return err
+}
+
+func (f *Server) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			defer conn.Close()
+			f.handle(conn)
+		}()
+	}
+}
+
+func (f *Server) handle(conn net.Conn) {
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id, _ := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		var responses []*ber.Packet
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			responses = append(responses, result(ldap.ApplicationBindResponse, f.bind(op)))
+		case ldap.ApplicationSearchRequest:
+			responses = f.search(op)
+		case ldap.ApplicationUnbindRequest:
+			return
+		case ldap.ApplicationExtendedRequest:
+			responses = append(responses, result(ldap.ApplicationExtendedResponse, ldap.LDAPResultProtocolError))
+		default:
+			return
+		}
+		for _, res := range responses {
+			envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			envelope.AppendChild(res)
+			if _, err := conn.Write(envelope.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (f *Server) bind(op *ber.Packet) int {
+	if len(op.Children) < 3 {
+		return ldap.LDAPResultProtocolError
+	}
+	dn := op.Children[1].Data.String()
+	password := op.Children[2].Data.String()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, e := range f.entries {
+		if strings.EqualFold(e.DN, dn) && e.Password != "" && e.Password == password {
+			f.binds = append(f.binds, e.DN)
+			return ldap.LDAPResultSuccess
+		}
+	}
+	return ldap.LDAPResultInvalidCredentials
+}
+
+func (f *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return []*ber.Packet{result(ldap.ApplicationSearchResultDone, ldap.LDAPResultProtocolError)}
+	}
+	base := strings.ToLower(op.Children[0].Data.String())
+	filter := op.Children[6]
+	var attributes []string
+	for _, a := range op.Children[7].Children {
+		attributes = append(attributes, a.Data.String())
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var responses []*ber.Packet
+	for _, e := range f.entries {
+		if !strings.HasSuffix(strings.ToLower(e.DN), base) || !e.matches(filter) {
+			continue
+		}
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.DN, "DN"))
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for _, name := range attributes {
+			values := e.attribute(name)
+			if values == nil {
+				continue
+			}
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+			set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attr.AppendChild(set)
+			attrs.AppendChild(attr)
+		}
+		entry.AppendChild(attrs)
+		responses = append(responses, entry)
+	}
+	return append(responses, result(ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess))
+}
+
+func (e *Entry) attribute(name string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (e *Entry) matches(filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !e.matches(child) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if e.matches(child) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(filter.Children) == 1 && !e.matches(filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		if len(filter.Children) != 2 {
+			return false
+		}
+		value := filter.Children[1].Data.String()
+		for _, v := range e.attribute(filter.Children[0].Data.String()) {
+			if strings.EqualFold(v, value) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		return e.attribute(filter.Data.String()) != nil
+	}
+	return false
+}
+
+func result(tag ber.Tag, code int) *ber.Packet {
+	res := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	res.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "ResultCode"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "MatchedDN"))
+	res.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "DiagnosticMessage"))
+	return res
+}
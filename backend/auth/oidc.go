@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/oauth2"
+)
+
+// ErrInvalidOIDCState はOIDCのコールバックのstateが不正・期限切れであることを表す
+var ErrInvalidOIDCState = errors.New("invalid or expired OIDC state")
+
+// oidcStateCookieName はログインを開始したブラウザを識別するstateを保存するクッキー名
+const oidcStateCookieName = "svmmgr_oidc_state"
+
+// oidcStateDuration はIdPでの認証にかけられる時間
+const oidcStateDuration = 10 * time.Minute
+
+// OIDCConfig はOpenID Connectでログインするための設定
+type OIDCConfig struct {
+	Issuer        string
+	ClientID      string
+	ClientSecret  string // 公開クライアントの場合は空 (PKCEのみで保護する)
+	RedirectURL   string // /auth/oidc/callback の外部から見たURL
+	Scopes        []string
+	UsernameClaim string // ユーザ名として使うクレーム
+	GroupsClaim   string // グループの一覧のクレーム
+}
+
+// OIDCIdentity はIdPで認証されたユーザの情報
+type OIDCIdentity struct {
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+type oidcState struct {
+	verifier  string // PKCEのcode_verifier
+	nonce     string
+	expiresAt time.Time
+}
+
+// OIDC は認可コードフロー (PKCE) でIdPにログインする
+type OIDC struct {
+	conf     OIDCConfig
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	mu     sync.Mutex
+	states map[string]oidcState
+}
+
+// NewOIDC はIdPのディスカバリを行い、ログインの準備をする
+func NewOIDC(ctx context.Context, conf OIDCConfig) (*OIDC, error) {
+	provider, err := oidc.NewProvider(ctx, conf.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	scopes := append([]string{oidc.ScopeOpenID}, conf.Scopes...)
+	return &OIDC{
+		conf: conf,
+		oauth2: oauth2.Config{
+			ClientID:     conf.ClientID,
+			ClientSecret: conf.ClientSecret,
+			RedirectURL:  conf.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       scopes,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: conf.ClientID}),
+		states:   make(map[string]oidcState),
+	}, nil
+}
+
+// Begin はログインを開始し、IdPの認可エンドポイントのURLを返す
+// state はクッキーにも保存し、コールバックが同じブラウザから来たことを確認する
+func (o *OIDC) Begin(c echo.Context) (string, error) {
+	state, err := generateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	o.mu.Lock()
+	now := time.Now()
+	for k, s := range o.states {
+		if now.After(s.expiresAt) {
+			delete(o.states, k)
+		}
+	}
+	o.states[state] = oidcState{verifier: verifier, nonce: nonce, expiresAt: now.Add(oidcStateDuration)}
+	o.mu.Unlock()
+
+	// IdPからのリダイレクトで送信されるよう SameSite=Lax にする
+	c.SetCookie(&http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state,
+		Path:     "/auth/oidc",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   int(oidcStateDuration.Seconds()),
+	})
+	return o.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// Finish はコールバックの認可コードをトークンに交換し、IDトークンを検証してユーザの情報を返す
+func (o *OIDC) Finish(c echo.Context) (*OIDCIdentity, error) {
+	state := c.QueryParam("state")
+	cookie, err := c.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || cookie.Value != state {
+		return nil, ErrInvalidOIDCState
+	}
+	c.SetCookie(&http.Cookie{Name: oidcStateCookieName, Path: "/auth/oidc", MaxAge: -1, HttpOnly: true, Secure: true})
+
+	o.mu.Lock()
+	s, ok := o.states[state]
+	delete(o.states, state)
+	o.mu.Unlock()
+	if !ok || time.Now().After(s.expiresAt) {
+		return nil, ErrInvalidOIDCState
+	}
+
+	if e := c.QueryParam("error"); e != "" {
+		return nil, errors.New("authorization failed: " + e)
+	}
+	ctx := c.Request().Context()
+	token, err := o.oauth2.Exchange(ctx, c.QueryParam("code"), oauth2.VerifierOption(s.verifier))
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, errors.New("no id_token in token response")
+	}
+	idToken, err := o.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	if idToken.Nonce != s.nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	identity := &OIDCIdentity{Subject: idToken.Subject}
+	identity.Username, _ = claims[o.conf.UsernameClaim].(string)
+	switch groups := claims[o.conf.GroupsClaim].(type) {
+	case []any:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	case string:
+		identity.Groups = []string{groups}
+	}
+	return identity, nil
+}
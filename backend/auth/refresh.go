@@ -4,12 +4,13 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/masa23/webapp-test/model"
-	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
 )
 
@@ -18,22 +19,46 @@ type LoginRequest struct {
 	Password string `json:"password"`
 }
 
-const cookieName = "svmmgr_token"
+// CookieName はリフレッシュトークンを保存するクッキー名
+const CookieName = "svmmgr_token"
 
 // ログインしてRefreshトークンを生成してクッキーに設定
-func Login(c echo.Context, db *gorm.DB, expired time.Duration) error {
+// パスワードは authenticator (ローカル・LDAPなど) で確認する
+// 二段階認証が有効または組織で必須の場合はチャレンジを返し、LoginTwoFactor でコードを確認してから生成する
+func Login(c echo.Context, db *gorm.DB, authenticator Authenticator, challenges *ChallengeStore, expired time.Duration) error {
 	var req LoginRequest
 	if err := c.Bind(&req); err != nil {
 		return errorMessage(c, "Invalid request format")
 	}
 
-	user, err := findUserByUsername(db, req.Username)
+	user, err := authenticator.Authenticate(c.Request().Context(), db, req.Username, req.Password)
 	if err != nil {
-		return errorMessage(c, err.Error())
+		var denied AccessDeniedError
+		switch {
+		case errors.Is(err, ErrInvalidCredentials):
+			return unauthorized(c)
+		case errors.As(err, &denied):
+			return c.JSON(http.StatusForbidden, map[string]string{"error": denied.Error()})
+		}
+		log.Println("ログインの認証に失敗:", err)
+		return c.JSON(http.StatusServiceUnavailable, map[string]string{"error": "Authentication service unavailable"})
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		return unauthorized(c)
+	required, err := TwoFactorRequired(db, user)
+	if err != nil {
+		return errorMessage(c, "Failed to check two-factor requirement: "+err.Error())
+	}
+	if user.TOTPEnabled || required {
+		challenge, expiresAt, err := challenges.Issue(user.ID, !user.TOTPEnabled)
+		if err != nil {
+			return errorMessage(c, "Failed to issue login challenge: "+err.Error())
+		}
+		return c.JSON(http.StatusOK, LoginChallengeResponse{
+			TwoFactorRequired:  true,
+			EnrollmentRequired: !user.TOTPEnabled,
+			Challenge:          challenge,
+			ExpiresAt:          expiresAt.Unix(),
+		})
 	}
 
 	// リフレッシュトークンを生成
@@ -59,14 +84,24 @@ type RefreshTokenResponse struct {
 	ExpiresAt   int64  `json:"expires_at"` // UNIXタイムスタンプ
 }
 
-func Refresh(c echo.Context, db *gorm.DB, jwtSecret string, expired time.Duration) error {
-	rt, err := CheckRefreshToken(c, db)
+// Refresh はリフレッシュトークンをローテーションしてアクセストークンを生成する
+// ローテーション済みのトークンが再び使われた場合はファミリーごと失効し、revoked を呼び出す
+// ローテーションの直後に古いトークンが使われた場合は 409 を返す
+func Refresh(c echo.Context, db *gorm.DB, jwtSecret string, expired time.Duration, revoked func(family string)) error {
+	rt, err := RotateRefreshToken(c, db)
 	if err != nil {
+		if errors.Is(err, ErrRefreshTokenConflict) {
+			return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+		}
+		if errors.Is(err, ErrRefreshTokenReused) && revoked != nil {
+			revoked(rt.Family)
+		}
 		return errorMessage(c, "Invalid or expired refresh token: "+err.Error())
 	}
 
 	// 新しいアクセストークンを生成
-	newAccessToken, err := GenerateJWTToken(c, rt.UserID, rt.Token, []byte(jwtSecret), expired)
+	// IDにはリフレッシュトークンそのものではなくファミリーを入れる
+	newAccessToken, err := GenerateJWTToken(c, rt.UserID, rt.Family, []byte(jwtSecret), expired)
 	if err != nil {
 		return errorMessage(c, "Failed to generate access token: "+err.Error())
 	}
@@ -79,7 +114,7 @@ func Refresh(c echo.Context, db *gorm.DB, jwtSecret string, expired time.Duratio
 
 func setRefreshTokenCookie(c echo.Context, token string, expired time.Duration) {
 	cookie := new(http.Cookie)
-	cookie.Name = cookieName
+	cookie.Name = CookieName
 	cookie.Value = token
 	cookie.HttpOnly = true
 	cookie.Secure = true
@@ -98,17 +133,27 @@ func generateSecureToken(n int) (string, error) {
 	return base64.URLEncoding.WithPadding(base64.NoPadding).EncodeToString(b), nil
 }
 
-func generateRefreshToken(userID uint64, db *gorm.DB, expired time.Duration) (*model.RefreshToken, error) {
+func generateRefreshToken(c echo.Context, userID uint64, db *gorm.DB, expired time.Duration) (*model.RefreshToken, error) {
 	// 32バイトのランダム値 → Base64で約43文字（URLセーフ）
 	token, err := generateSecureToken(32)
 	if err != nil {
 		return nil, err
 	}
 
+	family, err := generateSecureToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
 	rt := &model.RefreshToken{
-		Token:     token,
-		UserID:    userID,
-		ExpiresAt: time.Now().Add(expired),
+		Token:      token,
+		UserID:     userID,
+		ExpiresAt:  now.Add(expired),
+		Family:     family,
+		UserAgent:  userAgent(c),
+		IPAddress:  c.RealIP(),
+		LastUsedAt: &now,
 	}
 
 	if err := db.Create(rt).Error; err != nil {
@@ -118,7 +163,7 @@ func generateRefreshToken(userID uint64, db *gorm.DB, expired time.Duration) (*m
 }
 
 func GenerateRefreshToken(c echo.Context, userID uint64, db *gorm.DB, expired time.Duration) (*model.RefreshToken, error) {
-	rt, err := generateRefreshToken(userID, db, expired)
+	rt, err := generateRefreshToken(c, userID, db, expired)
 	if err != nil {
 		return nil, err
 	}
@@ -130,7 +175,7 @@ func GenerateRefreshToken(c echo.Context, userID uint64, db *gorm.DB, expired ti
 }
 
 func CheckRefreshToken(c echo.Context, db *gorm.DB) (*model.RefreshToken, error) {
-	tokenStr, err := c.Cookie(cookieName)
+	tokenStr, err := c.Cookie(CookieName)
 	if err != nil {
 		return nil, err
 	}
@@ -150,9 +195,129 @@ func CheckRefreshToken(c echo.Context, db *gorm.DB) (*model.RefreshToken, error)
 	return &rt, nil
 }
 
+// ErrRefreshTokenReused はローテーション済みのリフレッシュトークンが再び使われたことを表す
+// 盗まれたトークンが使われた可能性があるため、同じファミリーのトークンは全て失効する
+var ErrRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// ErrRefreshTokenConflict はローテーションの直後に古いトークンが使われたことを表す
+// 複数のタブから同時にリフレッシュした場合に起こるため失効はしないが、新しいトークンも発行しない
+// クッキーは先のリクエストの応答で置き換わっているため、クライアントはリフレッシュをやり直す
+var ErrRefreshTokenConflict = errors.New("refresh token was rotated by a concurrent request")
+
+// errRefreshTokenRotated は同時にローテーションされたことを表す
+var errRefreshTokenRotated = errors.New("refresh token has been rotated")
+
+// refreshTokenReuseInterval はローテーションの直後に古いトークンが使われてもファミリーを失効しない時間
+const refreshTokenReuseInterval = 10 * time.Second
+
+// RotateRefreshToken はクッキーのリフレッシュトークンを同じファミリーの新しいトークンに置き換え、
+// 新しいトークンをクッキーに設定する
+// 有効期限はログイン時のものを引き継ぐ
+// ErrRefreshTokenReused の場合は失効したトークンも返す
+// ローテーションの直後に古いトークンが使われた場合は ErrRefreshTokenConflict を返す
+func RotateRefreshToken(c echo.Context, db *gorm.DB) (*model.RefreshToken, error) {
+	rt, err := CheckRefreshToken(c, db)
+	if err != nil {
+		return nil, err
+	}
+	if rt.RotatedAt != nil {
+		return reusedRefreshToken(c, db, rt)
+	}
+	// ファミリーが導入される前に発行されたトークン
+	if rt.Family == "" {
+		if rt.Family, err = generateSecureToken(32); err != nil {
+			return nil, err
+		}
+		if err := db.Model(rt).UpdateColumn("family", rt.Family).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	token, err := generateSecureToken(32)
+	if err != nil {
+		return nil, err
+	}
+	// 作成日時はセッションの開始日時として引き継ぐ
+	now := time.Now()
+	next := &model.RefreshToken{
+		Model:      model.Model{CreatedAt: rt.CreatedAt},
+		Token:      token,
+		UserID:     rt.UserID,
+		ExpiresAt:  rt.ExpiresAt,
+		Family:     rt.Family,
+		UserAgent:  userAgent(c),
+		IPAddress:  c.RealIP(),
+		LastUsedAt: &now,
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		res := tx.Model(&model.RefreshToken{}).
+			Where("id = ? AND rotated_at IS NULL", rt.ID).
+			UpdateColumn("rotated_at", now)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errRefreshTokenRotated
+		}
+		return tx.Create(next).Error
+	})
+	if errors.Is(err, errRefreshTokenRotated) {
+		if err := db.First(rt, rt.ID).Error; err != nil {
+			return nil, err
+		}
+		return reusedRefreshToken(c, db, rt)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	setRefreshTokenCookie(c, next.Token, time.Until(next.ExpiresAt))
+	return next, nil
+}
+
+// reusedRefreshToken はローテーション済みのトークンが使われた場合の処理
+// ローテーションの直後であればトークンを発行せずに ErrRefreshTokenConflict を返し、それ以外はファミリーを失効する
+// どちらの場合もトークンは発行しない
+func reusedRefreshToken(c echo.Context, db *gorm.DB, rt *model.RefreshToken) (*model.RefreshToken, error) {
+	if time.Since(*rt.RotatedAt) < refreshTokenReuseInterval {
+		log.Printf("ローテーションの直後のリフレッシュトークンの使用を検出 (同時のリフレッシュまたは盗用): user_id=%d family=%s rotated_at=%s remote_ip=%s",
+			rt.UserID, rt.Family, rt.RotatedAt.Format(time.RFC3339), c.RealIP())
+		return nil, ErrRefreshTokenConflict
+	}
+
+	log.Printf("リフレッシュトークンの再利用を検出 (盗用の疑い) のためファミリーを失効: user_id=%d family=%s rotated_at=%s remote_ip=%s",
+		rt.UserID, rt.Family, rt.RotatedAt.Format(time.RFC3339), c.RealIP())
+	if err := RevokeRefreshTokenFamily(db, rt.Family); err != nil {
+		return nil, err
+	}
+	deleteRefreshTokenCookie(c)
+	return rt, ErrRefreshTokenReused
+}
+
+// RevokeRefreshTokenFamily はファミリーのリフレッシュトークンを全て削除する
+func RevokeRefreshTokenFamily(db *gorm.DB, family string) error {
+	return db.Unscoped().Where("family = ?", family).Delete(&model.RefreshToken{}).Error
+}
+
+// PurgeExpiredRefreshTokens は期限切れのリフレッシュトークンを削除し、削除した件数を返す
+// ローテーション済みのトークンも再利用の検出のため期限切れになるまで残している
+func PurgeExpiredRefreshTokens(db *gorm.DB) (int64, error) {
+	res := db.Unscoped().Where("expires_at <= ?", time.Now()).Delete(&model.RefreshToken{})
+	return res.RowsAffected, res.Error
+}
+
+// userAgent はセッションの一覧に表示するUser-Agentを返す
+func userAgent(c echo.Context) string {
+	ua := c.Request().UserAgent()
+	if len(ua) > 255 {
+		ua = strings.ToValidUTF8(ua[:255], "")
+	}
+	return ua
+}
+
 func deleteRefreshTokenCookie(c echo.Context) {
 	cookie := new(http.Cookie)
-	cookie.Name = cookieName
+	cookie.Name = CookieName
 	cookie.Value = ""
 	cookie.HttpOnly = true
 	cookie.Secure = true
@@ -163,13 +328,18 @@ func deleteRefreshTokenCookie(c echo.Context) {
 }
 
 func revokedRefreshToken(c echo.Context, db *gorm.DB) error {
-	tokenStr, err := c.Cookie(cookieName)
+	tokenStr, err := c.Cookie(CookieName)
 	if err != nil {
 		return err
 	}
 
-	// リフレッシュトークンをデータベースから削除
-	if err := db.Where("token = ?", tokenStr.Value).Delete(&model.RefreshToken{}).Error; err != nil {
+	// リフレッシュトークンをファミリーごとデータベースから削除
+	revoke := db.Where("token = ?", tokenStr.Value)
+	var rt model.RefreshToken
+	if err := db.Where("token = ?", tokenStr.Value).First(&rt).Error; err == nil && rt.Family != "" {
+		revoke = db.Where("family = ?", rt.Family)
+	}
+	if err := revoke.Delete(&model.RefreshToken{}).Error; err != nil {
 		if err == gorm.ErrRecordNotFound {
 			return errorMessage(c, "Refresh token not found")
 		}
@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// TicketKind はチケットの用途
+// 用途の異なるエンドポイントでは使えない
+type TicketKind string
+
+const (
+	TicketConsole TicketKind = "console" // VNC・シリアルコンソールへの接続
+	TicketReplay  TicketKind = "replay"  // 録画の再生
+)
+
+// ConsoleTicket はコンソール接続用の使い捨てチケット
+// WebSocketのクエリにアクセストークンを載せないために使う
+type ConsoleTicket struct {
+	Kind        TicketKind
+	UserID      uint64
+	ServerID    uint64 // Kind が TicketConsole の場合の接続先
+	RecordingID uint64 // Kind が TicketReplay の場合の録画
+	TokenID     string // 発行に使ったアクセストークンのID
+	ExpiresAt   time.Time
+}
+
+// target はチケットの対象のIDを返す
+func (t *ConsoleTicket) target() uint64 {
+	if t.Kind == TicketReplay {
+		return t.RecordingID
+	}
+	return t.ServerID
+}
+
+// TicketStore はコンソールチケットをメモリ上で管理する
+type TicketStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	tickets map[string]ConsoleTicket
+}
+
+func NewTicketStore(ttl time.Duration) *TicketStore {
+	return &TicketStore{ttl: ttl, tickets: make(map[string]ConsoleTicket)}
+}
+
+// Issue は用途と対象 (サーバまたは録画) を限定したチケットを発行する
+func (s *TicketStore) Issue(kind TicketKind, userID, targetID uint64, tokenID string) (string, time.Time, error) {
+	ticket, err := generateSecureToken(32)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(s.ttl)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// 期限切れのチケットを掃除する
+	now := time.Now()
+	for k, t := range s.tickets {
+		if now.After(t.ExpiresAt) {
+			delete(s.tickets, k)
+		}
+	}
+
+	t := ConsoleTicket{Kind: kind, UserID: userID, TokenID: tokenID, ExpiresAt: expiresAt}
+	if kind == TicketReplay {
+		t.RecordingID = targetID
+	} else {
+		t.ServerID = targetID
+	}
+	s.tickets[ticket] = t
+	return ticket, expiresAt, nil
+}
+
+// Redeem はチケットを検証して無効化する
+// チケットは成否に関わらず1度しか使えない
+func (s *TicketStore) Redeem(ticket string, kind TicketKind, targetID uint64) (*ConsoleTicket, error) {
+	s.mu.Lock()
+	t, ok := s.tickets[ticket]
+	delete(s.tickets, ticket)
+	s.mu.Unlock()
+
+	if !ok {
+		return nil, errors.New("ticket not found")
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return nil, errors.New("ticket has expired")
+	}
+	if t.Kind != kind {
+		return nil, errors.New("ticket is not for this purpose")
+	}
+	if t.target() != targetID {
+		return nil, errors.New("ticket is not for this target")
+	}
+	return &t, nil
+}
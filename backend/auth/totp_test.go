@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 Appendix B の SHA1 のテストベクタ (8桁の下6桁)
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		got, err := TOTPCode(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("TOTPCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	prev, _ := TOTPCode(secret, now.Add(-TOTPPeriod))
+	old, _ := TOTPCode(secret, now.Add(-3*TOTPPeriod))
+
+	step, ok := ValidateTOTP(secret, prev, now, 0)
+	if !ok || step != totpStep(now)-1 {
+		t.Errorf("previous step should be accepted: %d %v", step, ok)
+	}
+	if _, ok := ValidateTOTP(secret, prev, now, step); ok {
+		t.Error("used step should be rejected")
+	}
+	if _, ok := ValidateTOTP(secret, old, now, 0); ok {
+		t.Error("old code should be rejected")
+	}
+	if _, ok := ValidateTOTP(secret, "12345", now, 0); ok {
+		t.Error("short code should be rejected")
+	}
+}
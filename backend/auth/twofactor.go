@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidTwoFactorCode は二段階認証のコードが正しくないことを表す
+var ErrInvalidTwoFactorCode = errors.New("invalid two-factor code")
+
+// ErrTOTPAlreadyEnabled は既に二段階認証が有効であることを表す
+var ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+
+// ErrTOTPNotEnrolled は二段階認証の登録が開始されていないことを表す
+var ErrTOTPNotEnrolled = errors.New("two-factor authentication is not enrolled")
+
+// TwoFactorRequired はユーザが所属する組織のいずれかが二段階認証を必須にしているかを返す
+func TwoFactorRequired(db *gorm.DB, user *model.User) (bool, error) {
+	memberships := db.Model(&model.Membership{}).Select("organization_id").Where("user_id = ?", user.ID)
+	var count int64
+	err := db.Model(&model.Organization{}).
+		Where("require_two_factor = ?", true).
+		Where("(id = ? OR id IN (?))", user.OrganizationID, memberships).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// EnrollTOTP は新しいシークレットを生成して保存し、シークレットと otpauth URI を返す
+// EnableTOTP でコードを確認するまで二段階認証は有効にならない
+func EnrollTOTP(db *gorm.DB, user *model.User, issuer string) (string, string, error) {
+	if user.TOTPEnabled {
+		return "", "", ErrTOTPAlreadyEnabled
+	}
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := db.Model(user).UpdateColumn("totp_secret", secret).Error; err != nil {
+		return "", "", err
+	}
+	user.TOTPSecret = secret
+	return secret, TOTPURI(issuer, user.Username, secret), nil
+}
+
+// EnableTOTP は登録中のシークレットのコードを確認して二段階認証を有効にし、リカバリーコードを返す
+func EnableTOTP(db *gorm.DB, user *model.User, code string) ([]string, error) {
+	if user.TOTPEnabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if user.TOTPSecret == "" {
+		return nil, ErrTOTPNotEnrolled
+	}
+	step, ok := ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return nil, ErrInvalidTwoFactorCode
+	}
+
+	var codes []string
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).UpdateColumns(map[string]any{"totp_enabled": true, "totp_last_step": step}).Error; err != nil {
+			return err
+		}
+		var err error
+		codes, err = ReplaceRecoveryCodes(tx, user.ID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	user.TOTPEnabled = true
+	user.TOTPLastStep = step
+	return codes, nil
+}
+
+// DisableTOTP は二段階認証を無効にし、シークレットとリカバリーコードを削除する
+func DisableTOTP(db *gorm.DB, user *model.User) error {
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).UpdateColumns(map[string]any{"totp_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Where("user_id = ?", user.ID).Delete(&model.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return err
+	}
+	user.TOTPEnabled = false
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	return nil
+}
+
+// ReplaceRecoveryCodes はユーザのリカバリーコードを作り直し、新しいコードを返す
+// 保存するのはハッシュのみのため、コードを表示できるのはこの時だけ
+func ReplaceRecoveryCodes(db *gorm.DB, userID uint64) ([]string, error) {
+	codes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("user_id = ?", userID).Delete(&model.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		rows := make([]model.RecoveryCode, len(codes))
+		for i, code := range codes {
+			rows[i] = model.RecoveryCode{UserID: userID, CodeHash: HashRecoveryCode(code)}
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyTwoFactor は認証アプリのコードまたはリカバリーコードを確認する
+// 確認したコードは再利用できないよう記録する
+func VerifyTwoFactor(db *gorm.DB, user *model.User, code, recoveryCode string) error {
+	if !user.TOTPEnabled {
+		return ErrTOTPNotEnrolled
+	}
+
+	if recoveryCode != "" {
+		res := db.Model(&model.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, HashRecoveryCode(recoveryCode)).
+			UpdateColumn("used_at", time.Now())
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+
+	step, ok := ValidateTOTP(user.TOTPSecret, code, time.Now(), user.TOTPLastStep)
+	if !ok {
+		return ErrInvalidTwoFactorCode
+	}
+	// 同時に同じコードが使われた場合も1度しか通さない
+	res := db.Model(&model.User{}).
+		Where("id = ? AND totp_last_step < ?", user.ID, step).
+		UpdateColumn("totp_last_step", step)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrInvalidTwoFactorCode
+	}
+	user.TOTPLastStep = step
+	return nil
+}
+
+// LoginChallengeResponse はパスワード認証の後に二段階認証が必要な場合の応答
+type LoginChallengeResponse struct {
+	TwoFactorRequired  bool   `json:"two_factor_required"`
+	EnrollmentRequired bool   `json:"enrollment_required"` // 組織の設定で必須だが未登録のため登録が必要
+	Challenge          string `json:"challenge"`
+	ExpiresAt          int64  `json:"expires_at"` // UNIXタイムスタンプ
+}
+
+type LoginTwoFactorRequest struct {
+	Challenge    string `json:"challenge"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// LoginTwoFactorResponse は二段階認証を完了してログインした場合の応答
+type LoginTwoFactorResponse struct {
+	*model.RefreshToken
+	RecoveryCodes []string `json:"recovery_codes,omitempty"` // ログイン中に登録した場合のリカバリーコード
+}
+
+// LoginTwoFactor はチャレンジとコードを確認してRefreshトークンを生成してクッキーに設定する
+// 登録が必要なチャレンジの場合は LoginEnrollTOTP で生成したシークレットのコードで登録を完了する
+func LoginTwoFactor(c echo.Context, db *gorm.DB, challenges *ChallengeStore, expired time.Duration) error {
+	var req LoginTwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return errorMessage(c, "Invalid request format")
+	}
+
+	ch, err := challenges.Attempt(req.Challenge)
+	if err != nil {
+		return unauthorized(c)
+	}
+	var user model.User
+	if err := db.First(&user, ch.UserID).Error; err != nil {
+		return unauthorized(c)
+	}
+
+	var recoveryCodes []string
+	if ch.Enrollment {
+		recoveryCodes, err = EnableTOTP(db, &user, req.Code)
+	} else {
+		err = VerifyTwoFactor(db, &user, req.Code, req.RecoveryCode)
+	}
+	if err != nil {
+		if errors.Is(err, ErrInvalidTwoFactorCode) || errors.Is(err, ErrTOTPNotEnrolled) || errors.Is(err, ErrTOTPAlreadyEnabled) {
+			return unauthorized(c)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to verify two-factor code"})
+	}
+	challenges.Complete(req.Challenge)
+
+	rt, err := GenerateRefreshToken(c, user.ID, db, expired)
+	if err != nil {
+		return errorMessage(c, "Failed to generate refresh token: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, LoginTwoFactorResponse{RefreshToken: rt, RecoveryCodes: recoveryCodes})
+}
+
+// TOTPEnrollmentResponse は認証アプリに登録するシークレット
+type TOTPEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth URI (QRコードにして読み取らせる)
+}
+
+// LoginEnrollTOTP は二段階認証が必須の組織のユーザがログイン中に登録するためのシークレットを生成する
+func LoginEnrollTOTP(c echo.Context, db *gorm.DB, challenges *ChallengeStore, issuer string) error {
+	var req LoginTwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return errorMessage(c, "Invalid request format")
+	}
+
+	ch, err := challenges.Peek(req.Challenge)
+	if err != nil || !ch.Enrollment {
+		return unauthorized(c)
+	}
+	var user model.User
+	if err := db.First(&user, ch.UserID).Error; err != nil {
+		return unauthorized(c)
+	}
+
+	secret, uri, err := EnrollTOTP(db, &user, issuer)
+	if err != nil {
+		if errors.Is(err, ErrTOTPAlreadyEnabled) {
+			return unauthorized(c)
+		}
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to enroll two-factor authentication"})
+	}
+	return c.JSON(http.StatusOK, TOTPEnrollmentResponse{Secret: secret, URI: uri})
+}
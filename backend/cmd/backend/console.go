@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/model"
+	"github.com/masa23/webapp-test/server"
+)
+
+// シリアルコンソールのWebSocketプロトコル
+//
+// バイナリメッセージ: 端末への入力 (クライアント→サーバ) / 端末からの出力 (サーバ→クライアント)
+// テキストメッセージ: consoleControl のJSON (クライアント→サーバ)
+//
+//	{"type":"resize","cols":120,"rows":40}
+//	{"type":"detach"}
+
+type consoleControl struct {
+	Type string `json:"type"`
+	Cols int    `json:"cols"`
+	Rows int    `json:"rows"`
+}
+
+// virsh console から切断するためのエスケープ文字 (Ctrl+])
+const consoleEscape = 0x1d
+
+const (
+	defaultConsoleCols = 80
+	defaultConsoleRows = 24
+)
+
+func consoleSize(c echo.Context) (int, int) {
+	cols, _ := strconv.Atoi(c.QueryParam("cols"))
+	rows, _ := strconv.Atoi(c.QueryParam("rows"))
+	if cols < 1 {
+		cols = defaultConsoleCols
+	}
+	if rows < 1 {
+		rows = defaultConsoleRows
+	}
+	return cols, rows
+}
+
+func getServerConsoleHandler(c echo.Context) error {
+	user, sv, ticket, err := consoleTarget(c)
+	if err != nil {
+		return err
+	}
+
+	cols, rows := consoleSize(c)
+	stream, err := hv.ServerConsole(c.Request().Context(), *sv, cols, rows)
+	if err != nil {
+		if errors.Is(err, server.ErrStreamNotSupported) {
+			return echo.NewHTTPError(http.StatusNotImplemented, "Serial console is not supported")
+		}
+		return hypervisorError(err, "Failed to connect to serial console")
+	}
+
+	wsConn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		stream.Close()
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to upgrade to WebSocket")
+	}
+	defer wsConn.Close()
+
+	sess, err := startConsoleSession(c, "console", user, sv, ticket)
+	if err != nil {
+		stream.Close()
+		return nil
+	}
+	defer sessions.Remove(sess)
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	// コンソール → WebSocket
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stream.Read(buf)
+			if n > 0 {
+				if err := wsConn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+				sess.AddOut(n)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// WebSocket → コンソール
+	startKeepalive(wsConn)
+	inputDone := make(chan string, 1)
+	go func() {
+		inputDone <- consoleInput(wsConn, stream, sess)
+	}()
+
+	// 接続の制限・外部からの切断
+	type closeStatus struct {
+		code   int
+		reason string
+	}
+	supervised := make(chan closeStatus, 1)
+	go func() {
+		code, reason := superviseConsole(ctx, wsConn, sess)
+		supervised <- closeStatus{code, reason}
+	}()
+
+	code := websocket.CloseNormalClosure
+	reason := "console closed"
+	detach := false
+	select {
+	case s := <-supervised:
+		if s.code != 0 {
+			code, reason = s.code, s.reason
+			detach = true
+		}
+	case reason = <-inputDone:
+		detach = true
+	case <-outputDone:
+	}
+	if detach {
+		// コンソールを閉じる前に virsh console から抜ける
+		go stream.Write([]byte{consoleEscape})
+		select {
+		case <-outputDone:
+		case <-time.After(time.Second):
+		}
+	}
+	stream.Close()
+
+	closeWebSocket(wsConn, code, reason)
+	return nil
+}
+
+// consoleInput はクライアントからのメッセージをコンソールに渡す
+// 終了した理由を返す
+func consoleInput(wsConn *websocket.Conn, stream server.Stream, sess *console.Session) string {
+	for {
+		mt, msg, err := wsConn.ReadMessage()
+		if err != nil {
+			return "client disconnected"
+		}
+		switch mt {
+		case websocket.BinaryMessage:
+			if _, err := stream.Write(msg); err != nil {
+				return "console closed"
+			}
+			sess.AddIn(len(msg))
+		case websocket.TextMessage:
+			var ctrl consoleControl
+			if err := json.Unmarshal(msg, &ctrl); err != nil {
+				continue
+			}
+			switch ctrl.Type {
+			case "resize":
+				if ctrl.Cols > 0 && ctrl.Rows > 0 {
+					stream.Resize(ctrl.Cols, ctrl.Rows)
+				}
+			case "detach":
+				return "detached"
+			}
+		}
+	}
+}
+
+// closeWebSocket はクローズフレームを送信する
+func closeWebSocket(wsConn *websocket.Conn, code int, reason string) {
+	wsConn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, reason),
+		time.Now().Add(time.Second))
+}
+
+// startConsoleSession は接続中のセッションとして登録する
+// 終了時に sessions.Remove を呼び出すこと
+func startConsoleSession(c echo.Context, kind string, user *model.User, sv *model.Server, ticket *auth.ConsoleTicket) (*console.Session, error) {
+	return sessions.Add(&console.Session{
+		Kind:           kind,
+		UserID:         user.ID,
+		Username:       user.Username,
+		OrganizationID: sv.OrganizationID,
+		ServerID:       sv.ID,
+		ServerName:     sv.Name,
+		RemoteAddr:     c.RealIP(),
+		TokenID:        ticket.TokenID,
+	})
+}
+
+// powerOffAction は電源断に成功したらサーバのセッションを切断する
+func powerOffAction(action func(context.Context, model.Server) error) func(context.Context, model.Server) error {
+	return func(ctx context.Context, sv model.Server) error {
+		if err := action(ctx, sv); err != nil {
+			return err
+		}
+		sessions.CloseByServer(sv.ID, "server powered off")
+		return nil
+	}
+}
+
+// getConsoleSessionsHandler は組織内の接続中のセッションを返す
+func getConsoleSessionsHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	list := sessions.List(func(s *console.Session) bool {
+		return s.OrganizationID == user.OrganizationID
+	})
+	return c.JSON(http.StatusOK, list)
+}
+
+// deleteConsoleSessionHandler はセッションを強制的に切断する
+func deleteConsoleSessionHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	sess, ok := sessions.Get(c.Param("id"))
+	if !ok || sess.OrganizationID != user.OrganizationID {
+		return echo.NewHTTPError(http.StatusNotFound, "Session not found")
+	}
+	sess.Close("disconnected by " + user.Username)
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session disconnected successfully"})
+}
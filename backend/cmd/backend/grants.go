@@ -0,0 +1,382 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// grantPermissions はサーバ単位で付与された権限の一覧を返す
+func grantPermissions(g *model.ServerGrant) []model.Permissions {
+	var perms []model.Permissions
+	for _, p := range strings.Fields(g.Permissions) {
+		perms = append(perms, model.Permissions(p))
+	}
+	return perms
+}
+
+// mergePermissions は権限の一覧を重複なく結合する
+func mergePermissions(lists ...[]model.Permissions) []model.Permissions {
+	var merged []model.Permissions
+	for _, list := range lists {
+		for _, p := range list {
+			if !slices.Contains(merged, p) {
+				merged = append(merged, p)
+			}
+		}
+	}
+	return merged
+}
+
+// userGrants はユーザに直接またはグループ経由で付与された権限をサーバIDごとに返す
+// serverIDs を指定した場合はそのサーバのみを対象にする
+func userGrants(userID uint64, serverIDs ...uint64) (map[uint64][]model.Permissions, error) {
+	groups := db.Model(&model.GroupMember{}).Select("group_id").Where("user_id = ?", userID)
+	query := db.Where("(user_id = ? OR group_id IN (?))", userID, groups)
+	if len(serverIDs) > 0 {
+		query = query.Where("server_id IN ?", serverIDs)
+	}
+	var grants []model.ServerGrant
+	if err := query.Find(&grants).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[uint64][]model.Permissions)
+	for _, g := range grants {
+		result[g.ServerID] = mergePermissions(result[g.ServerID], grantPermissions(&g))
+	}
+	return result, nil
+}
+
+// serverPermissions はユーザがサーバに対して持つ権限を返す
+// 組織の役割の権限にサーバ単位で付与された権限を加えたもので、他の組織のサーバには権限を持たない
+func serverPermissions(user *model.User, sv *model.Server) ([]model.Permissions, error) {
+	if user.OrganizationID != sv.OrganizationID {
+		return nil, nil
+	}
+	grants, err := userGrants(user.ID, sv.ID)
+	if err != nil {
+		return nil, err
+	}
+	return mergePermissions(user.OrgPermissions(), grants[sv.ID]), nil
+}
+
+// revalidateConsoleSessions は条件に一致するコンソールセッションの権限を確認し直し、
+// コンソールの権限を失ったユーザの接続を切断する
+func revalidateConsoleSessions(match func(*console.Session) bool, reason string) {
+	for _, info := range sessions.List(match) {
+		var user model.User
+		var sv model.Server
+		if err := db.First(&user, info.UserID).Error; err != nil {
+			continue
+		}
+		if err := db.First(&sv, info.ServerID).Error; err != nil {
+			continue
+		}
+		member, err := asMember(&user, sv.OrganizationID)
+		if err != nil {
+			log.Println("コンソールセッションの権限の確認に失敗:", err)
+			continue
+		}
+		var perms []model.Permissions
+		if member != nil {
+			perms, err = serverPermissions(member, &sv)
+		}
+		if err != nil {
+			log.Println("コンソールセッションの権限の確認に失敗:", err)
+			continue
+		}
+		if !slices.Contains(perms, model.PermissionConsole) {
+			if s, ok := sessions.Get(info.ID); ok {
+				s.Close(reason)
+			}
+		}
+	}
+}
+
+type serverGrantResponse struct {
+	model.ServerGrant
+	Permissions []model.Permissions `json:"permissions"`
+}
+
+type createServerGrantRequest struct {
+	UserID      *uint64             `json:"user_id"`
+	GroupID     *uint64             `json:"group_id"`
+	Permissions []model.Permissions `json:"permissions"`
+}
+
+// manageableServer は組織の管理者が管理するサーバをパラメータから取得する
+func manageableServer(c echo.Context) (*model.User, *model.Server, error) {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return nil, nil, err
+	}
+	sv, err := getServerFromParam(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sv.OrganizationID != user.OrganizationID {
+		return nil, nil, echo.NewHTTPError(http.StatusNotFound, "Server not found")
+	}
+	return user, sv, nil
+}
+
+// getServerGrantsHandler はサーバに付与された権限の一覧を返す
+func getServerGrantsHandler(c echo.Context) error {
+	_, sv, err := manageableServer(c)
+	if err != nil {
+		return err
+	}
+
+	var grants []model.ServerGrant
+	if err := db.Where("server_id = ?", sv.ID).Order("id").Find(&grants).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	resp := make([]serverGrantResponse, 0, len(grants))
+	for _, g := range grants {
+		resp = append(resp, serverGrantResponse{ServerGrant: g, Permissions: grantPermissions(&g)})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// createServerGrantHandler は組織のユーザまたはグループにサーバの権限を付与する
+// 権限を付与したサーバは常に参照できる
+func createServerGrantHandler(c echo.Context) error {
+	user, sv, err := manageableServer(c)
+	if err != nil {
+		return err
+	}
+
+	var req createServerGrantRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	if (req.UserID == nil) == (req.GroupID == nil) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Either user_id or group_id is required")
+	}
+	for _, p := range req.Permissions {
+		if !slices.Contains(model.GrantablePermissions, p) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Permission cannot be granted: "+string(p))
+		}
+	}
+	perms := mergePermissions([]model.Permissions{model.PermissionView}, req.Permissions)
+
+	// 付与先は同じ組織のユーザまたはグループに限る
+	if req.UserID != nil {
+		if _, err := orgMember(user.OrganizationID, *req.UserID); err != nil {
+			if he, ok := err.(*echo.HTTPError); ok && he.Code == http.StatusNotFound {
+				return echo.NewHTTPError(http.StatusBadRequest, "User not found")
+			}
+			return err
+		}
+	} else {
+		var count int64
+		if err := db.Model(&model.Group{}).Where("id = ? AND organization_id = ?", *req.GroupID, user.OrganizationID).Count(&count).Error; err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+		}
+		if count == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Group not found")
+		}
+	}
+
+	names := make([]string, len(perms))
+	for i, p := range perms {
+		names[i] = string(p)
+	}
+	grant := model.ServerGrant{
+		ServerID:    sv.ID,
+		UserID:      req.UserID,
+		GroupID:     req.GroupID,
+		Permissions: strings.Join(names, " "),
+	}
+	if err := db.Create(&grant).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create grant")
+	}
+	return c.JSON(http.StatusCreated, serverGrantResponse{ServerGrant: grant, Permissions: perms})
+}
+
+// deleteServerGrantHandler はサーバに付与された権限を取り消す
+// 権限を失ったユーザのコンソール接続は切断する
+func deleteServerGrantHandler(c echo.Context) error {
+	_, sv, err := manageableServer(c)
+	if err != nil {
+		return err
+	}
+
+	res := db.Where("id = ? AND server_id = ?", parseUintParam(c, "grant_id"), sv.ID).Delete(&model.ServerGrant{})
+	if res.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if res.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "Grant not found")
+	}
+	revalidateConsoleSessions(func(s *console.Session) bool { return s.ServerID == sv.ID }, "access revoked")
+	return c.NoContent(http.StatusNoContent)
+}
+
+type groupResponse struct {
+	model.Group
+	MemberIDs []uint64 `json:"member_ids"`
+}
+
+type createGroupRequest struct {
+	Name string `json:"name"`
+}
+
+// getGroupFromParam は組織のグループをパラメータから取得する
+func getGroupFromParam(c echo.Context, user *model.User) (*model.Group, error) {
+	var group model.Group
+	if err := db.Where("id = ? AND organization_id = ?", parseUintParam(c, "id"), user.OrganizationID).First(&group).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "Group not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return &group, nil
+}
+
+// getGroupsHandler は組織のグループの一覧をメンバーのユーザID付きで返す
+func getGroupsHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	var groups []model.Group
+	if err := db.Where("organization_id = ?", user.OrganizationID).Order("id").Find(&groups).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	resp := make([]groupResponse, 0, len(groups))
+	for _, g := range groups {
+		memberIDs := []uint64{}
+		if err := db.Model(&model.GroupMember{}).Where("group_id = ?", g.ID).Order("user_id").Pluck("user_id", &memberIDs).Error; err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+		}
+		resp = append(resp, groupResponse{Group: g, MemberIDs: memberIDs})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// createGroupHandler は組織にグループを作成する
+func createGroupHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	var req createGroupRequest
+	if err := c.Bind(&req); err != nil || req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Name is required")
+	}
+	group := model.Group{OrganizationID: user.OrganizationID, Name: req.Name}
+	if err := db.Create(&group).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create group")
+	}
+	return c.JSON(http.StatusCreated, groupResponse{Group: group, MemberIDs: []uint64{}})
+}
+
+// deleteGroupHandler はグループとそのメンバー、グループへの権限の付与を削除する
+func deleteGroupHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+	group, err := getGroupFromParam(c, user)
+	if err != nil {
+		return err
+	}
+
+	var memberIDs []uint64
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&model.GroupMember{}).Where("group_id = ?", group.ID).Pluck("user_id", &memberIDs).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("group_id = ?", group.ID).Delete(&model.GroupMember{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("group_id = ?", group.ID).Delete(&model.ServerGrant{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(group).Error
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	revalidateConsoleSessions(func(s *console.Session) bool { return slices.Contains(memberIDs, s.UserID) }, "access revoked")
+	return c.NoContent(http.StatusNoContent)
+}
+
+// groupMemberTarget はグループとメンバーにするユーザをパラメータから取得する
+func groupMemberTarget(c echo.Context) (*model.Group, *model.User, error) {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return nil, nil, err
+	}
+	group, err := getGroupFromParam(c, user)
+	if err != nil {
+		return nil, nil, err
+	}
+	member, err := orgMember(user.OrganizationID, parseUintParam(c, "user_id"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return group, member, nil
+}
+
+// addGroupMemberHandler はユーザをグループに追加する
+func addGroupMemberHandler(c echo.Context) error {
+	group, member, err := groupMemberTarget(c)
+	if err != nil {
+		return err
+	}
+
+	var count int64
+	if err := db.Model(&model.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, member.ID).Count(&count).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if count == 0 {
+		if err := db.Create(&model.GroupMember{GroupID: group.ID, UserID: member.ID}).Error; err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to add group member")
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// removeGroupMemberHandler はユーザをグループから外す
+func removeGroupMemberHandler(c echo.Context) error {
+	group, member, err := groupMemberTarget(c)
+	if err != nil {
+		return err
+	}
+
+	res := db.Unscoped().Where("group_id = ? AND user_id = ?", group.ID, member.ID).Delete(&model.GroupMember{})
+	if res.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if res.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "User is not a member of the group")
+	}
+	revalidateConsoleSessions(func(s *console.Session) bool { return s.UserID == member.ID }, "access revoked")
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/masa23/webapp-test/console"
+)
+
+// コンソール接続を制限により切断した場合のクローズコード
+const (
+	closeIdleTimeout = 4000 // 無操作によるタイムアウト
+	closeMaxDuration = 4001 // 最大接続時間の超過
+)
+
+// startKeepalive はpongを受信するたびに読み込みの期限を延長するように設定する
+// pingに応答しないクライアントは読み込みがタイムアウトして切断される
+// WebSocketの読み込みを開始する前に呼び出すこと
+func startKeepalive(wsConn *websocket.Conn) {
+	pongWait := 2 * conf.Console.PingInterval
+	wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	wsConn.SetPongHandler(func(string) error {
+		return wsConn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+// superviseConsole は ctx が終了するまで定期的にpingを送信し、接続の制限を監視する
+// 制限を超えた場合や外部から切断された場合はクローズコードと理由を返す
+// ctx が終了した場合は 0 を返す
+func superviseConsole(ctx context.Context, wsConn *websocket.Conn, sess *console.Session) (int, string) {
+	ping := time.NewTicker(conf.Console.PingInterval)
+	defer ping.Stop()
+
+	var maxDuration <-chan time.Time
+	if d := conf.Console.MaxDuration; d > 0 {
+		timer := time.NewTimer(time.Until(sess.StartedAt.Add(d)))
+		defer timer.Stop()
+		maxDuration = timer.C
+	}
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if d := conf.Console.IdleTimeout; d > 0 {
+		idleTimer = time.NewTimer(time.Until(sess.LastInputAt().Add(d)))
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return 0, ""
+		case <-sess.Done():
+			return websocket.ClosePolicyViolation, sess.Reason()
+		case <-maxDuration:
+			return closeMaxDuration, "maximum session duration exceeded"
+		case <-idle:
+			// 最後の入力から期限までの残り時間を待ち直す
+			remaining := time.Until(sess.LastInputAt().Add(conf.Console.IdleTimeout))
+			if remaining <= 0 {
+				return closeIdleTimeout, "idle timeout"
+			}
+			idleTimer.Reset(remaining)
+		case <-ping.C:
+			if err := wsConn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return 0, ""
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// newAuthenticator はログインで使う認証方式を設定に従って順に並べる
+// ローカルのパスワードを先に確認し、認証できない場合はLDAPで認証する
+func newAuthenticator() (auth.Authenticator, error) {
+	authenticators := auth.Authenticators{auth.LocalAuthenticator{}}
+	if conf.LDAP.URL != "" {
+		ldap, err := newLDAPAuthenticator()
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, ldap)
+	}
+	return authenticators, nil
+}
+
+// newLDAPAuthenticator は設定からLDAPの認証を準備する
+func newLDAPAuthenticator() (*auth.LDAPAuthenticator, error) {
+	if err := validateGroupMappings("LDAP.GroupMappings", conf.LDAP.GroupMappings); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         conf.LDAP.TLS.ServerName,
+		InsecureSkipVerify: conf.LDAP.TLS.InsecureSkipVerify,
+	}
+	if tlsConfig.ServerName == "" {
+		u, err := url.Parse(conf.LDAP.URL)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = u.Hostname()
+	}
+	if conf.LDAP.TLS.CACert != "" {
+		pem, err := os.ReadFile(conf.LDAP.TLS.CACert)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("LDAP.TLS.CACert: no certificate found in " + conf.LDAP.TLS.CACert)
+		}
+	}
+
+	return &auth.LDAPAuthenticator{
+		Config: auth.LDAPConfig{
+			URL:            conf.LDAP.URL,
+			StartTLS:       conf.LDAP.StartTLS,
+			TLSConfig:      tlsConfig,
+			BindDN:         conf.LDAP.BindDN,
+			BindPassword:   conf.LDAP.BindPassword,
+			BaseDN:         conf.LDAP.BaseDN,
+			UserFilter:     conf.LDAP.UserFilter,
+			GroupAttribute: conf.LDAP.GroupAttribute,
+			Timeout:        conf.LDAP.Timeout,
+		},
+		Provision: ldapUser,
+	}, nil
+}
+
+// ldapUser はLDAPで認証されたユーザに対応するユーザを返す
+// ユーザはDNで照合し、初回のログイン時はパスワードを持たないユーザを作成して、ログインの度に所属する組織と役割を同期する
+// ローカル・OIDCのユーザなど、同じユーザ名でもDNが記録されていないユーザはLDAPのユーザとして扱わない
+func ldapUser(ctx context.Context, db *gorm.DB, dn, username string, groups []string) (*model.User, error) {
+	roles := mappedRoles(conf.LDAP.GroupMappings, groups)
+	if len(roles) == 0 {
+		return nil, auth.AccessDeniedError("No organization is mapped to the user's groups")
+	}
+
+	dn = strings.ToLower(dn)
+	var user model.User
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("ldap_dn = ?", dn).First(&user).Error
+		if err == nil {
+			return syncMemberships(tx, &user, roles)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		err = tx.Where("username = ?", username).First(&user).Error
+		switch {
+		case err == nil:
+			if user.Password != "" {
+				return auth.ErrInvalidCredentials
+			}
+			log.Printf("LDAPのユーザ %q (%s) を既存のユーザに紐付けない", username, dn)
+			return auth.AccessDeniedError("User already exists and is not linked to this LDAP account")
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			orgID := firstOrganization(roles)
+			user = model.User{Username: username, OrganizationID: orgID, Role: roles[orgID], LDAPDN: &dn}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+		return syncMemberships(tx, &user, roles)
+	})
+	if err != nil {
+		return nil, err
+	}
+	revalidateConsoleSessions(func(s *console.Session) bool { return s.UserID == user.ID }, "role changed")
+	return &user, nil
+}
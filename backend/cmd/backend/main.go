@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"io"
 	"log"
-	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 	echojwt "github.com/labstack/echo-jwt/v4"
@@ -15,6 +17,8 @@ import (
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/masa23/webapp-test/auth"
 	"github.com/masa23/webapp-test/config"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/libvirt"
 	"github.com/masa23/webapp-test/model"
 	"github.com/masa23/webapp-test/server"
 	"gorm.io/driver/sqlite"
@@ -23,14 +27,20 @@ import (
 
 var db *gorm.DB
 var conf *config.Config
+var hv *server.Hypervisor
+var reconciler *server.Reconciler
+var tickets *auth.TicketStore
+var challenges *auth.ChallengeStore
+var authenticator auth.Authenticator
+var sessions = console.NewRegistry()
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool { return true },
+	CheckOrigin: checkWebSocketOrigin,
 }
 
 // 共通関数
 func authenticatedUser(c echo.Context) (*model.User, error) {
-	userId, err := auth.JWTAuth(c)
+	userId, err := auth.UserID(c)
 	if err != nil || userId == nil {
 		return nil, echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
 	}
@@ -42,7 +52,23 @@ func authenticatedUser(c echo.Context) (*model.User, error) {
 		}
 		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
 	}
-	return &user, nil
+
+	// 組織が選択されている場合はその組織での役割で操作する
+	orgID, err := activeOrganizationID(c)
+	if err != nil {
+		return nil, err
+	}
+	if orgID == 0 {
+		return &user, nil
+	}
+	member, err := asMember(&user, orgID)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if member == nil {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "Not a member of the organization")
+	}
+	return member, nil
 }
 
 func getServerFromParam(c echo.Context) (*model.Server, error) {
@@ -64,14 +90,47 @@ func getServerFromParam(c echo.Context) (*model.Server, error) {
 	return &sv, nil
 }
 
-func checkOwnership(user *model.User, sv *model.Server) error {
-	if user.OrganizationID != sv.OrganizationID {
+// checkOwnership はユーザがサーバに対して権限を持つかを確認する
+// 組織の役割の権限に加えてサーバ単位で付与された権限も考慮する
+func checkOwnership(user *model.User, sv *model.Server, perm model.Permissions) error {
+	perms, err := serverPermissions(user, sv)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if len(perms) == 0 {
 		return echo.NewHTTPError(http.StatusForbidden, "Permission denied")
 	}
+	if !slices.Contains(perms, perm) {
+		return echo.NewHTTPError(http.StatusForbidden, "Permission denied: "+string(perm)+" is required")
+	}
+	return nil
+}
+
+// checkPermission はユーザが組織全体に対して権限を持つかを確認する
+// 制限付きユーザは組織全体に対する権限を持たない
+func checkPermission(user *model.User, perm model.Permissions) error {
+	if !slices.Contains(user.OrgPermissions(), perm) {
+		return echo.NewHTTPError(http.StatusForbidden, "Permission denied: "+string(perm)+" is required")
+	}
 	return nil
 }
 
-func serverActionHandler(action func(model.Server) error, successMsg string) echo.HandlerFunc {
+// hypervisorError はハイパーバイザ操作のエラーをHTTPエラーに変換する
+func hypervisorError(err error, message string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return echo.NewHTTPError(http.StatusGatewayTimeout, "Hypervisor did not respond in time")
+	}
+	if errors.Is(err, libvirt.ErrDenied) {
+		return echo.NewHTTPError(http.StatusForbidden, "Operation denied by hypervisor policy")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, message)
+}
+
+// actionReconcileDelay は電源操作の後に保存されている状態を更新するまでの時間
+// shutdown・start は非同期に状態が変わるため、直後に取得すると操作前の状態が保存される
+const actionReconcileDelay = 3 * time.Second
+
+func serverActionHandler(action func(context.Context, model.Server) error, perm model.Permissions, successMsg string) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		user, err := authenticatedUser(c)
 		if err != nil {
@@ -81,11 +140,15 @@ func serverActionHandler(action func(model.Server) error, successMsg string) ech
 		if err != nil {
 			return err
 		}
-		if err := checkOwnership(user, sv); err != nil {
+		if err := checkOwnership(user, sv, perm); err != nil {
 			return err
 		}
-		if err := action(*sv); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "Failed to execute action")
+		if err := action(c.Request().Context(), *sv); err != nil {
+			return hypervisorError(err, "Failed to execute action")
+		}
+		if reconciler != nil {
+			// 状態が変わるのを待ってから保存されている状態を更新しておく
+			reconciler.ReconcileLater(*sv, actionReconcileDelay)
 		}
 		return c.JSON(http.StatusOK, map[string]string{"message": successMsg})
 	}
@@ -93,15 +156,34 @@ func serverActionHandler(action func(model.Server) error, successMsg string) ech
 
 // ハンドラ群
 func loginHandler(c echo.Context) error {
-	return auth.Login(c, db, conf.RefreshToken.Duration)
+	return auth.Login(c, db, authenticator, challenges, conf.RefreshToken.Duration)
 }
 
 func logoutHandler(c echo.Context) error {
+	// 失効するリフレッシュトークンのファミリーで開始したコンソールセッションも切断する
+	if cookie, err := c.Cookie(auth.CookieName); err == nil {
+		var rt model.RefreshToken
+		if err := db.Where("token = ?", cookie.Value).First(&rt).Error; err == nil {
+			tokenID := rt.Family
+			if tokenID == "" {
+				tokenID = rt.Token // ファミリーが導入される前に発行されたトークン
+			}
+			defer sessions.CloseByToken(tokenID, "logged out")
+		}
+	}
 	return auth.Logout(c, db)
 }
 
 func refreshHandler(c echo.Context) error {
-	return auth.Refresh(c, db, conf.AccessToken.JWTSecret, conf.AccessToken.Duration)
+	// 盗用の疑いでファミリーを失効した場合は、そのファミリーで開始したコンソールセッションも切断する
+	return auth.Refresh(c, db, conf.AccessToken.JWTSecret, conf.AccessToken.Duration, func(family string) {
+		sessions.CloseByToken(family, "refresh token reuse detected")
+	})
+}
+
+type profileResponse struct {
+	model.User
+	Permissions []model.Permissions `json:"permissions"` // 組織全体に対する権限 (サーバごとの権限は各サーバに含まれる)
 }
 
 func profileHandler(c echo.Context) error {
@@ -109,7 +191,7 @@ func profileHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	return c.JSON(http.StatusOK, user)
+	return c.JSON(http.StatusOK, profileResponse{User: *user, Permissions: user.OrgPermissions()})
 }
 
 func getServersHandler(c echo.Context) error {
@@ -117,6 +199,20 @@ func getServersHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	// 制限付きユーザは権限を付与されたサーバのみを返す
+	grants, err := userGrants(user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	var serverIDs []uint64
+	if user.Restricted {
+		serverIDs = make([]uint64, 0, len(grants))
+		for id := range grants {
+			serverIDs = append(serverIDs, id)
+		}
+	} else if err := checkPermission(user, model.PermissionView); err != nil {
+		return err
+	}
 	page, _ := strconv.Atoi(c.QueryParam("page"))
 	pageSize, _ := strconv.Atoi(c.QueryParam("pageSize"))
 	if page < 1 {
@@ -126,11 +222,15 @@ func getServersHandler(c echo.Context) error {
 		pageSize = 10
 	}
 	search := c.QueryParam("search")
+	status := c.QueryParam("status")
 
-	resp, err := server.GetServersByOrganizationIDAndSearch(db, user.OrganizationID, search, page, pageSize)
+	resp, err := hv.GetServersByOrganizationIDAndSearch(c.Request().Context(), db, user.OrganizationID, serverIDs, search, status, page, pageSize)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to retrieve servers")
 	}
+	for i := range resp.Servers {
+		resp.Servers[i].Permissions = mergePermissions(user.OrgPermissions(), grants[resp.Servers[i].ID])
+	}
 	return c.JSON(http.StatusOK, resp)
 }
 
@@ -139,16 +239,22 @@ func getServerHandler(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	svResp, err := server.GetServerByID(db, parseUintParam(c, "id"))
+	sv, err := getServerFromParam(c)
 	if err != nil {
-		if err == gorm.ErrRecordNotFound {
-			return echo.NewHTTPError(http.StatusNotFound, "Server not found")
-		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to retrieve server")
+		return err
 	}
-	if err := checkOwnership(user, &svResp.Server); err != nil {
+	if err := checkOwnership(user, sv, model.PermissionView); err != nil {
 		return err
 	}
+	// 応答がない場合と拒否された場合以外は状態を "unknown" として返す
+	status, err := hv.ServerStatus(c.Request().Context(), *sv)
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, libvirt.ErrDenied) {
+		return hypervisorError(err, "Failed to retrieve server status")
+	}
+	svResp := server.ServerResponse{Server: *sv, Status: status}
+	if svResp.Permissions, err = serverPermissions(user, &svResp.Server); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
 	return c.JSON(http.StatusOK, svResp)
 }
 
@@ -186,38 +292,115 @@ func (w *wsWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func getServerVNCHandler(c echo.Context) error {
-	token := c.QueryParam("token")
-	if token == "" {
-		return echo.NewHTTPError(http.StatusBadRequest, "Token is required")
+// getServerScreenshotHandler は画面のサムネイルをPNGで返す
+// 稼働中の画面が見えるためコンソールの権限を必要とする
+func getServerScreenshotHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	sv, err := getServerFromParam(c)
+	if err != nil {
+		return err
+	}
+	if err := checkOwnership(user, sv, model.PermissionConsole); err != nil {
+		return err
 	}
 
-	userId, err := auth.JWTTokenAuth(c, token, conf.AccessToken.JWTSecret)
+	data, err := hv.ServerScreenshot(c.Request().Context(), *sv)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid token")
+		return hypervisorError(err, "Failed to get screenshot")
 	}
+	c.Response().Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(conf.Hypervisor.ScreenshotCacheTTL.Seconds())))
+	return c.Blob(http.StatusOK, "image/png", data)
+}
 
+// consoleTicketHandler はコンソール接続用の使い捨てチケットを発行する
+func consoleTicketHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
 	sv, err := getServerFromParam(c)
 	if err != nil {
 		return err
 	}
+	if err := checkOwnership(user, sv, model.PermissionConsole); err != nil {
+		return err
+	}
+
+	ticket, expiresAt, err := tickets.Issue(auth.TicketConsole, user.ID, sv.ID, auth.TokenID(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to issue console ticket")
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"ticket":     ticket,
+		"expires_at": expiresAt.Unix(),
+	})
+}
+
+// consoleTarget はWebSocketのクエリのチケットでユーザを認証し、接続先のサーバを返す
+// チケットはここで無効化される
+func consoleTarget(c echo.Context) (*model.User, *model.Server, *auth.ConsoleTicket, error) {
+	ticket := c.QueryParam("ticket")
+	if ticket == "" {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusBadRequest, "Ticket is required")
+	}
+
+	sv, err := getServerFromParam(c)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	t, err := tickets.Redeem(ticket, auth.TicketConsole, sv.ID)
+	if err != nil {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusUnauthorized, "Invalid ticket")
+	}
 
 	var user model.User
-	if err := db.First(&user, *userId).Error; err != nil {
-		return echo.NewHTTPError(http.StatusUnauthorized, "User not found")
+	if err := db.First(&user, t.UserID).Error; err != nil {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusUnauthorized, "User not found")
 	}
-	if err := checkOwnership(&user, sv); err != nil {
-		return err
+	// サーバの組織での役割で確認する
+	member, err := asMember(&user, sv.OrganizationID)
+	if err != nil {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if member == nil {
+		return nil, nil, nil, echo.NewHTTPError(http.StatusForbidden, "Permission denied")
+	}
+	// チケット発行後に権限が変更された場合に備えて接続時にも確認する
+	if err := checkOwnership(member, sv, model.PermissionConsole); err != nil {
+		return nil, nil, nil, err
 	}
+	return member, sv, t, nil
+}
+
+// countingWriter は書き込んだバイト数を add に渡す
+type countingWriter struct {
+	w   io.Writer
+	add func(int)
+}
 
-	port, err := server.ServerDomDisplay(*sv)
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.add(n)
+	return n, err
+}
+
+func getServerVNCHandler(c echo.Context) error {
+	user, sv, ticket, err := consoleTarget(c)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get VNC port")
+		return err
 	}
 
-	vncConn, err := net.Dial("tcp", sv.HostName+":"+strconv.Itoa(port))
+	tunnel := conf.VNCMode(sv.HostName) == config.VNCModeSSH
+	vncConn, err := hv.DialVNC(c.Request().Context(), *sv, tunnel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to connect to VNC server")
+		if errors.Is(err, server.ErrTunnelNotSupported) {
+			return echo.NewHTTPError(http.StatusNotImplemented, "VNC over SSH tunnel is not supported")
+		}
+		return hypervisorError(err, "Failed to connect to VNC server")
 	}
 
 	wsConn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
@@ -231,75 +414,207 @@ func getServerVNCHandler(c echo.Context) error {
 		vncConn.Close()
 	}()
 
+	sess, err := startConsoleSession(c, "vnc", user, sv, ticket)
+	if err != nil {
+		return nil
+	}
+	defer sessions.Remove(sess)
+
+	var toVNC io.Writer = vncConn
+	var toWS io.Writer = &wsWriter{conn: wsConn}
+
+	// 録画が有効な組織では録画できない場合は接続させない
+	rec, err := startRecording(user, sv, sess)
+	if err != nil {
+		log.Println("録画の開始に失敗:", err)
+		closeWebSocket(wsConn, websocket.CloseInternalServerErr, "failed to start recording")
+		return nil
+	}
+	if rec != nil {
+		defer rec.finish()
+		toVNC = rec.Tee(console.DirIn, toVNC)
+		toWS = rec.Tee(console.DirOut, toWS)
+	}
+
 	ctx, cancel := context.WithCancel(c.Request().Context())
 	defer cancel()
 
+	startKeepalive(wsConn)
 	wsR := &wsReader{conn: wsConn}
-	wsW := &wsWriter{conn: wsConn}
 
 	go func() {
 		defer cancel()
-		io.Copy(vncConn, wsR) // WebSocket → VNC
+		io.Copy(newRFBInputWriter(toVNC, sess.AddIn, sess.CountIn), wsR) // WebSocket → VNC
 	}()
 
 	go func() {
 		defer cancel()
-		io.Copy(wsW, vncConn) // VNC → WebSocket
+		io.Copy(&countingWriter{w: toWS, add: sess.AddOut}, vncConn) // VNC → WebSocket
 	}()
 
-	<-ctx.Done()
+	if code, reason := superviseConsole(ctx, wsConn, sess); code != 0 {
+		closeWebSocket(wsConn, code, reason)
+	}
 
 	return nil
 }
 
-func main() {
-	var confPath string
-	flag.StringVar(&confPath, "config", "config.yaml", "Path to config file")
-	flag.Parse()
-
-	var err error
-	conf, err = config.Load(confPath)
+func newExecutor(conf *config.Config) (server.Executor, error) {
+	if conf.Hypervisor.Executor == "local" {
+		return &server.LocalExecutor{}, nil
+	}
+	hostKeyCallback, err := server.NewHostKeyCallback(db, conf.Hypervisor.SSH.KnownHosts)
 	if err != nil {
-		log.Fatalf("Failed to load config: %v", err)
+		return nil, err
 	}
+	return server.NewSSHExecutor(conf.Hypervisor.User, conf.Hypervisor.SSH.PrivateKey, conf.Hypervisor.SSH.Port, hostKeyCallback)
+}
 
+func newEcho() *echo.Echo {
 	e := echo.New()
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins:     []string{"*"},
-		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAuthorization},
-		AllowCredentials: true,
+		// 同一オリジンのリクエストにはCORSのヘッダは不要
+		Skipper:          func(c echo.Context) bool { return sameOrigin(c.Request()) },
+		AllowOriginFunc:  allowCORSOrigin,
+		AllowHeaders:     []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAuthorization, organizationHeader},
+		AllowCredentials: conf.CORS.AllowCredentials,
 	}))
 
-	db, err = gorm.Open(sqlite.Open("test.sqlite3"), &gorm.Config{})
-	if err != nil {
-		e.Logger.Fatal("DB connection failed:", err)
-	}
-	if err := model.Migrate(db); err != nil {
-		e.Logger.Fatal("Migration failed:", err)
-	}
-
 	// ルーティング
 	e.POST("/auth/login", loginHandler)
+	e.POST("/auth/login/2fa", loginTwoFactorHandler)
+	e.POST("/auth/login/2fa/enroll", loginEnrollTOTPHandler)
+	e.GET("/auth/oidc/login", oidcLoginHandler)
+	e.GET("/auth/oidc/callback", oidcCallbackHandler)
 	e.GET("/auth/refresh", refreshHandler)
 	e.POST("/auth/logout", logoutHandler)
 	e.GET("/ws/server/:id/vnc", getServerVNCHandler)
+	e.GET("/ws/server/:id/console", getServerConsoleHandler)
+	e.GET("/ws/recordings/:id/replay", replayRecordingHandler)
 
 	api := e.Group("/api")
 	api.Use(echojwt.WithConfig(echojwt.Config{
+		// APIキーのリクエストは apiKeyMiddleware で認証する
+		Skipper:       auth.IsAPIKeyRequest,
 		NewClaimsFunc: auth.NewJWTClaims,
 		SigningKey:    []byte(conf.AccessToken.JWTSecret),
 	}))
+	api.Use(apiKeyMiddleware)
+
+	api.GET("/orgs", getOrganizationsHandler, requireScope(auth.ScopeRead))
+	api.GET("/tokens", getAPITokensHandler, requireSession)
+	api.POST("/tokens", createAPITokenHandler, requireSession)
+	api.DELETE("/tokens/:id", deleteAPITokenHandler, requireSession)
+	api.POST("/2fa/enroll", enrollTOTPHandler, requireSession)
+	api.POST("/2fa/verify", verifyTOTPHandler, requireSession)
+	api.POST("/2fa/recovery-codes", regenerateRecoveryCodesHandler, requireSession)
+	api.DELETE("/2fa", disableTOTPHandler, requireSession)
+	api.GET("/sessions", getSessionsHandler, requireSession)
+	api.DELETE("/sessions", deleteSessionsHandler, requireSession)
+	api.DELETE("/sessions/:id", deleteSessionHandler, requireSession)
+
+	// 組織ごとのAPIは X-Organization-ID ヘッダまたは /api/orgs/:org/ で組織を選択できる
+	registerOrgRoutes(api)
+	registerOrgRoutes(api.Group("/orgs/:org"))
+
+	return e
+}
 
-	api.GET("/profile", profileHandler)
-	api.GET("/servers", getServersHandler)
-	api.GET("/server/:id", getServerHandler)
-	api.POST("/server/:id/power/off", serverActionHandler(server.ServerPowerOff, "Server powered off successfully"))
-	api.POST("/server/:id/power/on", serverActionHandler(server.ServerPowerOn, "Server powered on successfully"))
-	api.POST("/server/:id/power/reboot", serverActionHandler(server.ServerReboot, "Server rebooted successfully"))
-	api.POST("/server/:id/power/force-reboot", serverActionHandler(server.ServerForceReboot, "Server force rebooted successfully"))
-	api.POST("/server/:id/power/force-off", serverActionHandler(server.ServerForcePowerOff, "Server force powered off successfully"))
+// registerOrgRoutes は組織ごとのAPIを登録する
+func registerOrgRoutes(g *echo.Group) {
+	read := requireScope(auth.ScopeRead)
+	power := requireScope(auth.ScopePower)
+	consoleScope := requireScope(auth.ScopeConsole)
+
+	g.GET("/profile", profileHandler, read)
+	g.GET("/servers", getServersHandler, read)
+	g.GET("/server/:id", getServerHandler, read)
+	g.POST("/server/:id/console-ticket", consoleTicketHandler, consoleScope)
+	g.GET("/server/:id/screenshot", getServerScreenshotHandler, consoleScope)
+	g.POST("/server/:id/power/off", serverActionHandler(powerOffAction(hv.ServerPowerOff), model.PermissionPower, "Server powered off successfully"), power)
+	g.POST("/server/:id/power/on", serverActionHandler(hv.ServerPowerOn, model.PermissionPower, "Server powered on successfully"), power)
+	g.POST("/server/:id/power/reboot", serverActionHandler(hv.ServerReboot, model.PermissionPower, "Server rebooted successfully"), power)
+	g.POST("/server/:id/power/force-reboot", serverActionHandler(hv.ServerForceReboot, model.PermissionForcePower, "Server force rebooted successfully"), power)
+	g.POST("/server/:id/power/force-off", serverActionHandler(powerOffAction(hv.ServerForcePowerOff), model.PermissionForcePower, "Server force powered off successfully"), power)
+	g.GET("/console-sessions", getConsoleSessionsHandler, read)
+	g.DELETE("/console-sessions/:id", deleteConsoleSessionHandler, consoleScope)
+	g.GET("/recordings", getRecordingsHandler, read)
+	g.POST("/recordings/:id/replay-ticket", recordingTicketHandler, consoleScope)
+	g.GET("/users", getUsersHandler, read)
+	g.PUT("/users/:id/role", updateUserRoleHandler, requireSession)
+	g.PUT("/users/:id/restricted", updateUserRestrictedHandler, requireSession)
+	g.GET("/users/:id/sessions", getUserSessionsHandler, requireSession)
+	g.DELETE("/users/:id/sessions", deleteUserSessionsHandler, requireSession)
+	g.DELETE("/users/:id/sessions/:session_id", deleteUserSessionHandler, requireSession)
+	g.GET("/server/:id/grants", getServerGrantsHandler, read)
+	g.POST("/server/:id/grants", createServerGrantHandler, requireSession)
+	g.DELETE("/server/:id/grants/:grant_id", deleteServerGrantHandler, requireSession)
+	g.GET("/groups", getGroupsHandler, read)
+	g.POST("/groups", createGroupHandler, requireSession)
+	g.DELETE("/groups/:id", deleteGroupHandler, requireSession)
+	g.PUT("/groups/:id/members/:user_id", addGroupMemberHandler, requireSession)
+	g.DELETE("/groups/:id/members/:user_id", removeGroupMemberHandler, requireSession)
+	g.PUT("/organization/two-factor", updateTwoFactorPolicyHandler, requireSession)
+	g.PUT("/organization/recording", updateRecordingPolicyHandler, requireSession)
+}
+
+func main() {
+	var confPath string
+	flag.StringVar(&confPath, "config", "config.yaml", "Path to config file")
+	flag.Parse()
+
+	var err error
+	conf, err = config.Load(confPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	db, err = gorm.Open(sqlite.Open("test.sqlite3"), &gorm.Config{})
+	if err != nil {
+		log.Fatalf("DB connection failed: %v", err)
+	}
+	if err := model.Migrate(db); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	executor, err := newExecutor(conf)
+	if err != nil {
+		log.Fatalf("Failed to initialize hypervisor executor: %v", err)
+	}
+	tickets = auth.NewTicketStore(conf.Console.TicketDuration)
+	challenges = auth.NewChallengeStore(conf.TwoFactor.ChallengeDuration)
+	authenticator, err = newAuthenticator()
+	if err != nil {
+		log.Fatalf("Failed to initialize authenticator: %v", err)
+	}
+	if conf.OIDC.Issuer != "" {
+		oidcProvider, err = newOIDC(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to initialize OIDC: %v", err)
+		}
+	}
+
+	hv = server.NewHypervisor(executor, server.Options{
+		Timeouts: server.Timeouts{
+			Status:     conf.Hypervisor.Timeout.Status,
+			Power:      conf.Hypervisor.Timeout.Power,
+			Display:    conf.Hypervisor.Timeout.Display,
+			Screenshot: conf.Hypervisor.Timeout.Screenshot,
+		},
+		Concurrency:        conf.Hypervisor.Concurrency,
+		StatusCacheTTL:     conf.Hypervisor.StatusCacheTTL,
+		ScreenshotCacheTTL: conf.Hypervisor.ScreenshotCacheTTL,
+		StoredState:        conf.Hypervisor.ReconcileInterval > 0,
+	})
+
+	if conf.Hypervisor.ReconcileInterval > 0 {
+		reconciler = server.NewReconciler(db, hv, conf.Hypervisor.ReconcileInterval)
+		go reconciler.Run(context.Background())
+	}
+	go cleanupRefreshTokens(context.Background(), conf.RefreshToken.CleanupInterval)
 
+	e := newEcho()
 	e.Logger.Fatal(e.Start(":8080"))
 }
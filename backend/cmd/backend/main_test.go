@@ -0,0 +1,2000 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/auth/ldaptest"
+	"github.com/masa23/webapp-test/config"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/model"
+	"github.com/masa23/webapp-test/server"
+	"github.com/masa23/webapp-test/server/servertest"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// setupTest はインメモリDBとフェイクのハイパーバイザでバックエンドを組み立てる
+func setupTest(t *testing.T) (*echo.Echo, *servertest.FakeExecutor) {
+	t.Helper()
+
+	conf = &config.Config{}
+	conf.AccessToken.JWTSecret = "test-secret"
+	conf.AccessToken.Duration = time.Minute
+	conf.RefreshToken.Duration = time.Hour
+	conf.Console.PingInterval = 30 * time.Second
+	conf.TwoFactor.Issuer = "svmmgr"
+	tickets = auth.NewTicketStore(time.Minute)
+	challenges = auth.NewChallengeStore(time.Minute)
+	authenticator = auth.Authenticators{auth.LocalAuthenticator{}}
+	sessions = console.NewRegistry()
+
+	// 次のテストがグローバル変数を書き換える前に接続中のハンドラの終了を待つ
+	registry := sessions
+	t.Cleanup(func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for len(registry.List(func(*console.Session) bool { return true })) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	var err error
+	db, err = gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatalf("DB connection failed: %v", err)
+	}
+	if err := model.Migrate(db); err != nil {
+		t.Fatalf("Migration failed: %v", err)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []any{
+		&model.Organization{Model: model.Model{ID: 1}, Name: "org1"},
+		&model.Organization{Model: model.Model{ID: 2}, Name: "org2"},
+		&model.User{Model: model.Model{ID: 1}, Username: "alice", Password: string(hash), OrganizationID: 1, Role: model.RoleAdmin},
+		&model.User{Model: model.Model{ID: 2}, Username: "bob", Password: string(hash), OrganizationID: 2, Role: model.RoleAdmin},
+		&model.Server{Model: model.Model{ID: 1}, Name: "vm1", HostName: "kvm1", OrganizationID: 1},
+		&model.Server{Model: model.Model{ID: 2}, Name: "vm2", HostName: "kvm1", OrganizationID: 2},
+		&model.Server{Model: model.Model{ID: 3}, Name: "vm3", HostName: "kvm2", OrganizationID: 1},
+	} {
+		if err := db.Create(v).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake := servertest.NewFakeExecutor()
+	fake.AddDomain("kvm1", "vm1", "shut off", 0)
+	fake.AddDomain("kvm1", "vm2", "running", 1)
+	fake.AddDomain("kvm2", "vm3", "running", 0)
+	hv = server.NewHypervisor(fake, server.Options{
+		Timeouts: server.Timeouts{
+			Status:     100 * time.Millisecond,
+			Power:      100 * time.Millisecond,
+			Display:    100 * time.Millisecond,
+			Screenshot: 100 * time.Millisecond,
+		},
+		Concurrency:        2,
+		StatusCacheTTL:     time.Minute,
+		ScreenshotCacheTTL: time.Minute,
+	})
+
+	return newEcho(), fake
+}
+
+func doRequest(e *echo.Echo, method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// login はログインからアクセストークンの取得までを行い、APIリクエスト用のヘッダを返す
+func login(t *testing.T, e *echo.Echo, username, password string) http.Header {
+	t.Helper()
+
+	rec := doRequest(e, http.MethodPost, "/auth/login", `{"username":"`+username+`","password":"`+password+`"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login failed: %d %s", rec.Code, rec.Body.String())
+	}
+	return accessHeader(t, e, rec)
+}
+
+// accessHeader はログインの応答のクッキーでアクセストークンを取得し、APIリクエスト用のヘッダを返す
+func accessHeader(t *testing.T, e *echo.Echo, rec *httptest.ResponseRecorder) http.Header {
+	t.Helper()
+
+	i := slices.IndexFunc(rec.Result().Cookies(), func(c *http.Cookie) bool { return c.Name == auth.CookieName })
+	if i < 0 {
+		t.Fatalf("no refresh token cookie: %s", rec.Body.String())
+	}
+	cookie := rec.Result().Cookies()[i]
+
+	rec = doRequest(e, http.MethodGet, "/auth/refresh", "", http.Header{"Cookie": {cookie.Name + "=" + cookie.Value}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var res struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return http.Header{"Authorization": {"Bearer " + res.AccessToken}}
+}
+
+// consoleTicket はコンソール接続用のチケットを取得する
+func consoleTicket(t *testing.T, e *echo.Echo, h http.Header, id string) string {
+	t.Helper()
+
+	rec := doRequest(e, http.MethodPost, "/api/server/"+id+"/console-ticket", "", h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("console-ticket failed: %d %s", rec.Code, rec.Body.String())
+	}
+	var res struct {
+		Ticket string `json:"ticket"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res.Ticket
+}
+
+func TestGetServer(t *testing.T) {
+	e, _ := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	rec := doRequest(e, http.MethodGet, "/api/server/1", "", h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var res server.ServerResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Server.Name != "vm1" || res.Status != "shut off" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+
+	// 他の組織のサーバは参照できない
+	rec = doRequest(e, http.MethodGet, "/api/server/2", "", h)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
+
+func TestGetServers(t *testing.T) {
+	e, fake := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	rec := doRequest(e, http.MethodGet, "/api/servers", "", h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var res server.ServersResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for _, sv := range res.Servers {
+		statuses[sv.Name] = sv.Status
+	}
+	if res.TotalCount != 2 || statuses["vm1"] != "shut off" || statuses["vm3"] != "running" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+
+	// 状態で絞り込む
+	rec = doRequest(e, http.MethodGet, "/api/servers?status=running", "", h)
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.TotalCount != 1 || len(res.Servers) != 1 || res.Servers[0].Name != "vm3" {
+		t.Errorf("unexpected response: %+v", res)
+	}
+
+	// 2回目はキャッシュから返すのでハイパーバイザに問い合わせない
+	if calls := fake.Calls(); len(calls) != 2 {
+		t.Errorf("unexpected hypervisor calls: %v", calls)
+	}
+}
+
+func TestServerPowerAction(t *testing.T) {
+	e, fake := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	rec := doRequest(e, http.MethodPost, "/api/server/1/power/on", "", h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if d, _ := fake.Domain("kvm1", "vm1"); d.State != "running" {
+		t.Errorf("domain state = %q, want running", d.State)
+	}
+
+	// 既に起動しているので失敗する
+	rec = doRequest(e, http.MethodPost, "/api/server/1/power/on", "", h)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// 他の組織のサーバは操作できない
+	rec = doRequest(e, http.MethodPost, "/api/server/2/power/force-off", "", h)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if d, _ := fake.Domain("kvm1", "vm2"); d.State != "running" {
+		t.Errorf("domain state = %q, want running", d.State)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	e, fake := setupTest(t)
+
+	// トークンなしはechojwtが400を返す
+	rec := doRequest(e, http.MethodPost, "/api/server/1/power/on", "", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("unexpected hypervisor calls: %v", calls)
+	}
+}
+
+func TestServerPowerActionTimeout(t *testing.T) {
+	e, fake := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	fake.Delay = time.Second
+	rec := doRequest(e, http.MethodPost, "/api/server/1/power/on", "", h)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "Hypervisor did not respond in time") {
+		t.Errorf("unexpected body: %s", rec.Body.String())
+	}
+
+	// 状態の取得のタイムアウトも "unknown" ではなく 504 を返す
+	rec = doRequest(e, http.MethodGet, "/api/server/1", "", h)
+	if rec.Code != http.StatusGatewayTimeout || !strings.Contains(rec.Body.String(), "Hypervisor did not respond in time") {
+		t.Errorf("get server: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// それ以外の失敗では状態を "unknown" として返す
+	fake.Delay = 0
+	fake.Err = errors.New("connection refused")
+	rec = doRequest(e, http.MethodGet, "/api/server/1", "", h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("get server: %d %s", rec.Code, rec.Body.String())
+	}
+	var res server.ServerResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "unknown" {
+		t.Errorf("status = %q, want unknown", res.Status)
+	}
+}
+
+func TestServerConsole(t *testing.T) {
+	e, fake := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	// 停止中のサーバには接続できない
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/1/console?ticket="+consoleTicket(t, e, h, "1"), nil); err == nil {
+		t.Fatal("connected to stopped server")
+	}
+	// 他の組織のサーバのチケットは発行できない
+	if rec := doRequest(e, http.MethodPost, "/api/server/2/console-ticket", "", h); rec.Code != http.StatusForbidden {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/console?ticket="+consoleTicket(t, e, h, "3")+"&cols=100&rows=30", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	mt, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt != websocket.BinaryMessage || string(msg) != "ls\r" {
+		t.Errorf("unexpected message: %d %q", mt, msg)
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"resize","cols":120,"rows":40}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"detach"}`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 切断時にエスケープ文字が送られてから閉じられる
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("unexpected close: %v", err)
+			}
+			break
+		}
+		if string(msg) != "\x1d" {
+			t.Errorf("unexpected message: %q", msg)
+		}
+	}
+
+	streams := fake.Streams()
+	if len(streams) != 1 {
+		t.Fatalf("streams = %d, want 1", len(streams))
+	}
+	if !streams[0].Closed() {
+		t.Error("stream is not closed")
+	}
+	want := [][2]int{{100, 30}, {120, 40}}
+	if got := streams[0].Resizes(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("resizes = %v, want %v", got, want)
+	}
+}
+
+func TestServerVNCTunnel(t *testing.T) {
+	e, fake := setupTest(t)
+	conf.Hypervisor.VNC.Mode = config.VNCModeDirect
+	conf.Hypervisor.VNC.Hosts = map[string]string{"kvm2": config.VNCModeSSH}
+	h := login(t, e, "alice", "password")
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+consoleTicket(t, e, h, "3"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != servertest.FakeRFBVersion {
+		t.Errorf("unexpected message: %q", msg)
+	}
+
+	// ハイパーバイザのlocalhostのVNCポートにSSH経由で接続している
+	if dials := fake.Dials(); len(dials) != 1 || dials[0] != "kvm2: 127.0.0.1:5900" {
+		t.Errorf("unexpected dials: %v", dials)
+	}
+}
+
+func TestConsoleTicket(t *testing.T) {
+	e, _ := setupTest(t)
+	conf.Hypervisor.VNC.Mode = config.VNCModeSSH
+	h := login(t, e, "alice", "password")
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	// アクセストークンでは接続できない
+	token := strings.TrimPrefix(h.Get("Authorization"), "Bearer ")
+	if _, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?token="+token, nil); err == nil {
+		t.Fatal("connected with access token")
+	}
+
+	// 別のサーバのチケットでは接続できず、チケットは無効になる
+	ticket := consoleTicket(t, e, h, "1")
+	if _, res, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+ticket, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("connected with ticket for another server")
+	}
+	if _, res, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/1/vnc?ticket="+ticket, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("connected with used ticket")
+	}
+
+	// チケットは1度しか使えない
+	ticket = consoleTicket(t, e, h, "3")
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+ticket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, res, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+ticket, nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Fatal("connected with used ticket")
+	}
+}
+
+func TestConsoleSessions(t *testing.T) {
+	e, _ := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	dial := func() *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/console?ticket="+consoleTicket(t, e, h, "3"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ls\r")); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	waitClosed := func(conn *websocket.Conn, reason string) {
+		t.Helper()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				var ce *websocket.CloseError
+				if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation || ce.Text != reason {
+					t.Errorf("unexpected close: %v", err)
+				}
+				return
+			}
+		}
+	}
+
+	conn := dial()
+	defer conn.Close()
+
+	rec := doRequest(e, http.MethodGet, "/api/console-sessions", "", h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	var list []console.SessionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("sessions = %d, want 1", len(list))
+	}
+	if s := list[0]; s.Kind != "console" || s.Username != "alice" || s.ServerID != 3 || s.BytesIn != 3 || s.BytesOut != 3 {
+		t.Errorf("unexpected session: %+v", s)
+	}
+
+	// 他の組織のユーザからは見えない
+	hb := login(t, e, "bob", "password")
+	if rec := doRequest(e, http.MethodGet, "/api/console-sessions", "", hb); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Errorf("unexpected response: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodDelete, "/api/console-sessions/"+list[0].ID, "", hb); rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// 強制切断
+	if rec := doRequest(e, http.MethodDelete, "/api/console-sessions/"+list[0].ID, "", h); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	waitClosed(conn, "disconnected by alice")
+
+	// 電源断で切断される
+	conn2 := dial()
+	defer conn2.Close()
+	if rec := doRequest(e, http.MethodPost, "/api/server/3/power/force-off", "", h); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	waitClosed(conn2, "server powered off")
+}
+
+func TestConsoleRecording(t *testing.T) {
+	e, _ := setupTest(t)
+	conf.Hypervisor.VNC.Mode = config.VNCModeSSH
+	conf.Console.RecordingDir = t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&model.User{Username: "carol", Password: string(hash), OrganizationID: 1, Role: model.RoleOperator}).Error; err != nil {
+		t.Fatal(err)
+	}
+	h := login(t, e, "alice", "password")
+
+	// 録画の有効・無効は組織の管理者のみ変更できる
+	if rec := doRequest(e, http.MethodPut, "/api/organization/recording", `{"enabled":true}`, login(t, e, "carol", "password")); rec.Code != http.StatusForbidden {
+		t.Errorf("operator: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodPut, "/api/organization/recording", `{"enabled":true}`, h); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"record_console":true`) {
+		t.Fatalf("enable recording: %d %s", rec.Code, rec.Body.String())
+	}
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+consoleTicket(t, e, h, "3"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "hello" {
+		t.Fatalf("unexpected message: %q %v", msg, err)
+	}
+	conn.Close()
+
+	// 切断後に録画が終了する
+	var rec model.ConsoleRecording
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if err := db.First(&rec).Error; err == nil && rec.EndedAt != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("recording is not finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if want := int64(len(servertest.FakeRFBVersion) + 10); rec.Size != want {
+		t.Errorf("size = %d, want %d", rec.Size, want)
+	}
+
+	rec1 := doRequest(e, http.MethodGet, "/api/recordings?server_id=3", "", h)
+	if rec1.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec1.Code)
+	}
+	var list []model.ConsoleRecording
+	if err := json.Unmarshal(rec1.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Username != "alice" || list[0].ServerName != "vm3" {
+		t.Fatalf("unexpected recordings: %+v", list)
+	}
+	id := strconv.FormatUint(list[0].ID, 10)
+
+	// 他の組織からは再生できない
+	if rec := doRequest(e, http.MethodPost, "/api/recordings/"+id+"/replay-ticket", "", login(t, e, "bob", "password")); rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	replayTicket := func() string {
+		t.Helper()
+		rec := doRequest(e, http.MethodPost, "/api/recordings/"+id+"/replay-ticket", "", h)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", rec.Code)
+		}
+		var res struct {
+			Ticket string `json:"ticket"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Ticket
+	}
+
+	// 再生用のチケットではコンソールに接続できず、コンソール用のチケットでは再生できない
+	if _, res, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+replayTicket(), nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Error("connected to console with replay ticket")
+	}
+	if _, res, err := websocket.DefaultDialer.Dial(wsURL+"/ws/recordings/"+id+"/replay?ticket="+consoleTicket(t, e, h, "3"), nil); err == nil || res.StatusCode != http.StatusUnauthorized {
+		t.Error("replayed recording with console ticket")
+	}
+
+	// サーバ → クライアントのデータのみが再生される
+	replay, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/recordings/"+id+"/replay?speed=64&ticket="+replayTicket(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	var got []string
+	for {
+		_, msg, err := replay.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("unexpected close: %v", err)
+			}
+			break
+		}
+		got = append(got, string(msg))
+	}
+	if len(got) != 2 || got[0] != servertest.FakeRFBVersion || got[1] != "hello" {
+		t.Errorf("unexpected replay: %q", got)
+	}
+}
+
+func TestConsoleLimits(t *testing.T) {
+	e, _ := setupTest(t)
+	conf.Hypervisor.VNC.Mode = config.VNCModeSSH
+	conf.Console.PingInterval = 50 * time.Millisecond
+	h := login(t, e, "alice", "password")
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	dial := func() *websocket.Conn {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+consoleTicket(t, e, h, "3"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ProtocolVersion, セキュリティタイプ None, ClientInit
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte("RFB 003.008\n\x01\x01")); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	// msg を送り続けながら切断されるまで読み込み、クローズコードを返す
+	closeCode := func(conn *websocket.Conn, msg []byte) (int, time.Duration) {
+		t.Helper()
+		start := time.Now()
+		stop := make(chan struct{})
+		defer close(stop)
+		if msg != nil {
+			go func() {
+				for {
+					select {
+					case <-stop:
+						return
+					case <-time.After(20 * time.Millisecond):
+						conn.WriteMessage(websocket.BinaryMessage, msg)
+					}
+				}
+			}()
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				var ce *websocket.CloseError
+				if !errors.As(err, &ce) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return ce.Code, time.Since(start)
+			}
+		}
+	}
+
+	// 入力がなければ切断される (pingへの応答は入力とみなさない)
+	conf.Console.IdleTimeout = 200 * time.Millisecond
+	conn := dial()
+	defer conn.Close()
+	if code, _ := closeCode(conn, nil); code != closeIdleTimeout {
+		t.Errorf("close code = %d, want %d", code, closeIdleTimeout)
+	}
+
+	// 画面の更新要求はクライアントが自動で送るので入力とみなさない
+	fbUpdateRequest := []byte{3, 1, 0, 0, 0, 0, 0x04, 0x00, 0x03, 0x00}
+	conn2 := dial()
+	defer conn2.Close()
+	if code, _ := closeCode(conn2, fbUpdateRequest); code != closeIdleTimeout {
+		t.Errorf("close code = %d, want %d", code, closeIdleTimeout)
+	}
+
+	// マウスの操作を続けていれば無操作では切断されず、最大接続時間で切断される
+	conf.Console.MaxDuration = 500 * time.Millisecond
+	pointerEvent := []byte{5, 0, 0, 10, 0, 20}
+	conn3 := dial()
+	defer conn3.Close()
+	code, elapsed := closeCode(conn3, pointerEvent)
+	if code != closeMaxDuration {
+		t.Errorf("close code = %d, want %d", code, closeMaxDuration)
+	}
+	if elapsed < 400*time.Millisecond {
+		t.Errorf("closed too early: %v", elapsed)
+	}
+}
+
+func TestRFBInputWriter(t *testing.T) {
+	var in, other int
+	var buf bytes.Buffer
+	w := newRFBInputWriter(&buf, func(n int) { in += n }, func(n int) { other += n })
+
+	stream := []byte("RFB 003.008\n\x02")
+	stream = append(stream, make([]byte, 16)...)                      // VNC認証のレスポンス
+	stream = append(stream, 1)                                        // ClientInit
+	stream = append(stream, 2, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 7)       // SetEncodings
+	stream = append(stream, 6, 0, 0, 0, 0, 0, 0, 3, 'a', 'b', 'c')    // ClientCutText
+	stream = append(stream, 3, 1, 0, 0, 0, 0, 4, 0, 3, 0)             // FramebufferUpdateRequest
+	stream = append(stream, 255, 0, 0, 1, 0, 0, 0, 0x61, 0, 0, 0, 30) // QEMUの拡張キーイベント
+	stream = append(stream, 4, 1, 0, 0, 0, 0, 0, 0x61)                // KeyEvent
+	stream = append(stream, 5, 0, 0, 10, 0, 20)                       // PointerEvent
+
+	// 1バイトずつ書き込んでも区切りを追える
+	for i := range stream {
+		if _, err := w.Write(stream[i : i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(buf.Bytes(), stream) {
+		t.Error("stream was not written through")
+	}
+	if in != 12+8+6 || other != len(stream)-in {
+		t.Errorf("input = %d, other = %d", in, other)
+	}
+
+	// 解析できないストリームは全てを入力とみなす
+	in, other = 0, 0
+	w = newRFBInputWriter(io.Discard, func(n int) { in += n }, func(n int) { other += n })
+	w.Write([]byte("RFB 003.008\n\x01\x01"))
+	w.Write([]byte{99, 1, 2, 3})
+	w.Write([]byte{3, 0})
+	if in != 6 || other != 14 {
+		t.Errorf("input = %d, other = %d", in, other)
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	e, _ := setupTest(t)
+	conf.Hypervisor.VNC.Mode = config.VNCModeSSH
+	conf.CORS.AllowOrigins = []string{"https://app.example.com"}
+	conf.CORS.AllowCredentials = true
+	e = newEcho() // CORSの設定を反映する
+	h := login(t, e, "alice", "password")
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		return doRequest(e, http.MethodOptions, "/auth/login", "", http.Header{
+			echo.HeaderOrigin:                     {origin},
+			echo.HeaderAccessControlRequestMethod: {http.MethodPost},
+		})
+	}
+	rec := preflight("https://app.example.com")
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowOrigin); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := rec.Header().Get(echo.HeaderAccessControlAllowCredentials); got != "true" {
+		t.Errorf("Access-Control-Allow-Credentials = %q", got)
+	}
+	if got := preflight("https://evil.example.com").Header().Get(echo.HeaderAccessControlAllowOrigin); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want empty", got)
+	}
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	wsURL := "ws" + strings.TrimPrefix(ts.URL, "http")
+
+	// 許可されていないオリジンからは接続できない
+	_, res, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+consoleTicket(t, e, h, "3"),
+		http.Header{"Origin": {"https://evil.example.com"}})
+	if err == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("connected from disallowed origin: %v", err)
+	}
+
+	for _, origin := range []string{"https://APP.example.com", ts.URL} {
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL+"/ws/server/3/vnc?ticket="+consoleTicket(t, e, h, "3"),
+			http.Header{"Origin": {origin}})
+		if err != nil {
+			t.Fatalf("%s: %v", origin, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestServerScreenshot(t *testing.T) {
+	e, fake := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	for i := 0; i < 2; i++ {
+		rec := doRequest(e, http.MethodGet, "/api/server/3/screenshot", "", h)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d", rec.Code)
+		}
+		if ct := rec.Header().Get(echo.HeaderContentType); ct != "image/png" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 640x480 から縮小される
+		if b := img.Bounds(); b.Dx() != 320 || b.Dy() != 240 {
+			t.Errorf("unexpected size: %v", b)
+		}
+	}
+
+	// 2回目はキャッシュから返す
+	n := 0
+	for _, call := range fake.Calls() {
+		if strings.Contains(call, "screenshot vm3") {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("screenshot called %d times, want 1", n)
+	}
+
+	// 他の組織のサーバ
+	if rec := doRequest(e, http.MethodGet, "/api/server/2/screenshot", "", h); rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	// 停止中のサーバ
+	if rec := doRequest(e, http.MethodGet, "/api/server/1/screenshot", "", h); rec.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// 稼働中の画面が見えるため参照のみの役割では取得できない
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&model.User{Username: "carol", Password: string(hash), OrganizationID: 1, Role: model.RoleViewer}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/server/3/screenshot", "", login(t, e, "carol", "password")); rec.Code != http.StatusForbidden {
+		t.Errorf("viewer: %d", rec.Code)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	e, _ := setupTest(t)
+	h := login(t, e, "alice", "password")
+
+	// 不正なスコープ・過去の有効期限
+	for _, body := range []string{
+		`{"name":"ci","scopes":["admin"]}`,
+		`{"name":"ci","expires_at":"2000-01-01T00:00:00Z"}`,
+		`{"name":""}`,
+	} {
+		if rec := doRequest(e, http.MethodPost, "/api/tokens", body, h); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status: %d", body, rec.Code)
+		}
+	}
+
+	rec := doRequest(e, http.MethodPost, "/api/tokens", `{"name":"ci","scopes":["read"]}`, h)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		Token struct {
+			ID     uint64   `json:"id"`
+			Scopes []string `json:"scopes"`
+		} `json:"token"`
+		Secret string `json:"secret"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if len(created.Token.Scopes) != 1 || created.Token.Scopes[0] != "read" {
+		t.Errorf("unexpected scopes: %v", created.Token.Scopes)
+	}
+	key := http.Header{echo.HeaderAuthorization: {"ApiKey " + created.Secret}}
+
+	if rec := doRequest(e, http.MethodGet, "/api/servers", "", key); rec.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	// スコープにない操作
+	if rec := doRequest(e, http.MethodPost, "/api/server/3/power/off", "", key); rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	// トークンの管理はAPIキーではできない
+	if rec := doRequest(e, http.MethodGet, "/api/tokens", "", key); rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	// シークレットが違う
+	access, _, _ := strings.Cut(created.Secret, ":")
+	bad := http.Header{echo.HeaderAuthorization: {"ApiKey " + access + ":" + strings.Repeat("x", 72)}}
+	if rec := doRequest(e, http.MethodGet, "/api/servers", "", bad); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// 一覧にはシークレットを含まない
+	rec = doRequest(e, http.MethodGet, "/api/tokens", "", h)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	var list []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0]["last_used_at"] == nil {
+		t.Errorf("unexpected tokens: %v", list)
+	}
+	if strings.Contains(rec.Body.String(), strings.TrimPrefix(created.Secret, access+":")) || strings.Contains(rec.Body.String(), "$2a$") {
+		t.Error("token list contains secret")
+	}
+
+	// 他のユーザのトークンは失効できない
+	path := "/api/tokens/" + strconv.FormatUint(created.Token.ID, 10)
+	if rec := doRequest(e, http.MethodDelete, path, "", login(t, e, "bob", "password")); rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodDelete, path, "", h); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/servers", "", key); rec.Code != http.StatusUnauthorized {
+		t.Errorf("revoked token: unexpected status: %d", rec.Code)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	e, _ := setupTest(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []*model.User{
+		{Username: "carol", Password: string(hash), OrganizationID: 1, Role: model.RoleViewer},
+		{Username: "dave", Password: string(hash), OrganizationID: 1, Role: model.RoleOperator},
+	} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := login(t, e, "alice", "password")
+	viewer := login(t, e, "carol", "password")
+	operator := login(t, e, "dave", "password")
+
+	tests := []struct {
+		header http.Header
+		method string
+		path   string
+		want   int
+	}{
+		{viewer, http.MethodGet, "/api/servers", http.StatusOK},
+		{viewer, http.MethodGet, "/api/server/3", http.StatusOK},
+		{viewer, http.MethodPost, "/api/server/1/power/on", http.StatusForbidden},
+		{viewer, http.MethodPost, "/api/server/3/console-ticket", http.StatusForbidden},
+		{operator, http.MethodPost, "/api/server/1/power/on", http.StatusOK},
+		{operator, http.MethodPost, "/api/server/3/power/force-off", http.StatusForbidden},
+		{operator, http.MethodPost, "/api/server/3/console-ticket", http.StatusOK},
+		{operator, http.MethodGet, "/api/console-sessions", http.StatusForbidden},
+		{operator, http.MethodGet, "/api/users", http.StatusForbidden},
+		{admin, http.MethodGet, "/api/console-sessions", http.StatusOK},
+		{admin, http.MethodPost, "/api/server/3/power/force-off", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if rec := doRequest(e, tt.method, tt.path, "", tt.header); rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+
+	// プロフィールで権限を返す
+	rec := doRequest(e, http.MethodGet, "/api/profile", "", operator)
+	var profile struct {
+		Role        string   `json:"role"`
+		Permissions []string `json:"permissions"`
+		Password    *string  `json:"password"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &profile); err != nil {
+		t.Fatal(err)
+	}
+	if profile.Role != "operator" || strings.Join(profile.Permissions, ",") != "view,power,console" {
+		t.Errorf("unexpected profile: %+v", profile)
+	}
+	if profile.Password != nil {
+		t.Error("profile contains password")
+	}
+
+	// 役割の変更
+	if rec := doRequest(e, http.MethodPut, "/api/users/3/role", `{"role":"admin"}`, operator); rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodPut, "/api/users/3/role", `{"role":"owner"}`, admin); rec.Code != http.StatusBadRequest {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodPut, "/api/users/3/role", `{"role":"operator"}`, admin); rec.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/server/1/power/off", "", viewer); rec.Code != http.StatusOK {
+		t.Errorf("promoted user: unexpected status: %d", rec.Code)
+	}
+	// 他の組織のユーザ
+	if rec := doRequest(e, http.MethodPut, "/api/users/2/role", `{"role":"viewer"}`, admin); rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	// 最後の admin
+	if rec := doRequest(e, http.MethodPut, "/api/users/1/role", `{"role":"viewer"}`, admin); rec.Code != http.StatusConflict {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
+
+func TestServerGrants(t *testing.T) {
+	e, _ := setupTest(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&model.User{Username: "erin", Password: string(hash), OrganizationID: 1, Role: model.RoleOperator}).Error; err != nil {
+		t.Fatal(err)
+	}
+	admin := login(t, e, "alice", "password")
+	contractor := login(t, e, "erin", "password")
+	other := login(t, e, "bob", "password")
+
+	listServers := func() server.ServersResponse {
+		t.Helper()
+		rec := doRequest(e, http.MethodGet, "/api/servers", "", contractor)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+		}
+		var res server.ServersResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// 制限付きユーザは権限を付与されたサーバのみ操作できる
+	if rec := doRequest(e, http.MethodPut, "/api/users/3/restricted", `{"restricted":true}`, admin); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if res := listServers(); res.TotalCount != 0 || len(res.Servers) != 0 {
+		t.Errorf("unexpected servers: %+v", res)
+	}
+	rec := doRequest(e, http.MethodPost, "/api/server/3/grants", `{"user_id":3,"permissions":["power"]}`, admin)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var grant struct {
+		ID          uint64   `json:"id"`
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &grant); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(grant.Permissions, ",") != "view,power" {
+		t.Errorf("unexpected grant: %+v", grant)
+	}
+	res := listServers()
+	if res.TotalCount != 1 || len(res.Servers) != 1 || res.Servers[0].Name != "vm3" || len(res.Servers[0].Permissions) != 2 {
+		t.Errorf("unexpected servers: %+v", res)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		want   int
+	}{
+		{http.MethodGet, "/api/server/3", http.StatusOK},
+		{http.MethodGet, "/api/server/1", http.StatusForbidden},
+		{http.MethodPost, "/api/server/3/power/reboot", http.StatusOK},
+		{http.MethodPost, "/api/server/3/power/force-reboot", http.StatusForbidden},
+		{http.MethodPost, "/api/server/3/console-ticket", http.StatusForbidden},
+		{http.MethodPost, "/api/server/1/power/on", http.StatusForbidden},
+		{http.MethodGet, "/api/users", http.StatusForbidden},
+		{http.MethodGet, "/api/server/3/grants", http.StatusForbidden},
+		{http.MethodPost, "/api/server/1/grants", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if rec := doRequest(e, tt.method, tt.path, `{"user_id":3,"permissions":["console"]}`, contractor); rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+
+	// グループ経由での付与
+	if rec := doRequest(e, http.MethodPost, "/api/groups", `{"name":"contractors"}`, admin); rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodPut, "/api/groups/1/members/3", "", admin); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/server/1/grants", `{"group_id":1,"permissions":["console"]}`, admin); rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if res := listServers(); res.TotalCount != 2 {
+		t.Errorf("unexpected servers: %+v", res)
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/server/1/console-ticket", "", contractor); rec.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// 不正な付与
+	for _, body := range []string{
+		`{"user_id":3,"permissions":["manage"]}`,
+		`{"user_id":2,"permissions":["view"]}`,
+		`{"user_id":3,"group_id":1,"permissions":["view"]}`,
+		`{"permissions":["view"]}`,
+	} {
+		if rec := doRequest(e, http.MethodPost, "/api/server/1/grants", body, admin); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status: %d", body, rec.Code)
+		}
+	}
+	// 他の組織のサーバ
+	if rec := doRequest(e, http.MethodGet, "/api/server/1/grants", "", other); rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// グループから外すとグループ経由の権限を失う
+	if rec := doRequest(e, http.MethodDelete, "/api/groups/1/members/3", "", admin); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/server/1", "", contractor); rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// 付与を取り消す
+	if rec := doRequest(e, http.MethodDelete, "/api/server/3/grants/"+strconv.FormatUint(grant.ID, 10), "", admin); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/server/3", "", contractor); rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+
+	// 制限を解除すると役割の権限で操作できる
+	if rec := doRequest(e, http.MethodPut, "/api/users/3/restricted", `{"restricted":false}`, admin); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d", rec.Code)
+	}
+	if res := listServers(); res.TotalCount != 2 {
+		t.Errorf("unexpected servers: %+v", res)
+	}
+	// 最後の admin は制限できない
+	if rec := doRequest(e, http.MethodPut, "/api/users/1/restricted", `{"restricted":true}`, admin); rec.Code != http.StatusConflict {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
+
+func TestOrganizations(t *testing.T) {
+	e, fake := setupTest(t)
+	for _, v := range []any{
+		&model.Organization{Model: model.Model{ID: 3}, Name: "org3"},
+		&model.Membership{UserID: 1, OrganizationID: 2, Role: model.RoleOperator},
+	} {
+		if err := db.Create(v).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice := login(t, e, "alice", "password")
+	bob := login(t, e, "bob", "password")
+
+	// 所属する組織の一覧
+	rec := doRequest(e, http.MethodGet, "/api/orgs", "", alice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var orgs []struct {
+		ID      uint64 `json:"id"`
+		Name    string `json:"name"`
+		Role    string `json:"role"`
+		Default bool   `json:"default"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &orgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(orgs) != 2 || orgs[0].ID != 1 || orgs[0].Role != "admin" || !orgs[0].Default ||
+		orgs[1].ID != 2 || orgs[1].Role != "operator" || orgs[1].Default {
+		t.Errorf("unexpected organizations: %+v", orgs)
+	}
+
+	// パスまたはヘッダで選択した組織のサーバを返す
+	orgHeader := alice.Clone()
+	orgHeader.Set("X-Organization-ID", "2")
+	for name, req := range map[string]struct {
+		path   string
+		header http.Header
+	}{
+		"path":   {"/api/orgs/2/servers", alice},
+		"header": {"/api/servers", orgHeader},
+	} {
+		rec := doRequest(e, http.MethodGet, req.path, "", req.header)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status: %d %s", name, rec.Code, rec.Body.String())
+		}
+		var res server.ServersResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.TotalCount != 1 || res.Servers[0].Name != "vm2" {
+			t.Errorf("%s: unexpected servers: %+v", name, res)
+		}
+	}
+
+	tests := []struct {
+		header http.Header
+		method string
+		path   string
+		want   int
+	}{
+		{alice, http.MethodGet, "/api/servers", http.StatusOK},
+		{alice, http.MethodGet, "/api/orgs/2/server/2", http.StatusOK},
+		{alice, http.MethodGet, "/api/orgs/2/server/1", http.StatusForbidden},
+		{alice, http.MethodGet, "/api/orgs/1/server/2", http.StatusForbidden},
+		{alice, http.MethodPost, "/api/orgs/2/server/2/power/reboot", http.StatusOK},
+		{alice, http.MethodPost, "/api/orgs/2/server/2/power/force-off", http.StatusForbidden},
+		{alice, http.MethodGet, "/api/orgs/2/users", http.StatusForbidden},
+		{alice, http.MethodGet, "/api/orgs/3/servers", http.StatusForbidden},
+		{alice, http.MethodGet, "/api/orgs/abc/servers", http.StatusBadRequest},
+		{bob, http.MethodGet, "/api/orgs/1/servers", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if rec := doRequest(e, tt.method, tt.path, "", tt.header); rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+	if calls := fake.Calls(); !slices.Contains(calls, "kvm1: virsh-wrapper --json reboot vm2") {
+		t.Errorf("unexpected hypervisor calls: %v", calls)
+	}
+
+	// 組織の管理者は他の組織から所属するユーザの役割を変更できる
+	rec = doRequest(e, http.MethodGet, "/api/users", "", bob)
+	var users []model.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].Username != "alice" || users[0].Role != model.RoleOperator {
+		t.Errorf("unexpected users: %+v", users)
+	}
+	if rec := doRequest(e, http.MethodPut, "/api/users/1/role", `{"role":"viewer"}`, bob); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/orgs/2/server/2/power/reboot", "", alice); rec.Code != http.StatusForbidden {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	// 既定の組織での役割は変わらない
+	if rec := doRequest(e, http.MethodPost, "/api/server/3/power/reboot", "", alice); rec.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	e, _ := setupTest(t)
+	alice := login(t, e, "alice", "password")
+
+	// 登録
+	rec := doRequest(e, http.MethodPost, "/api/2fa/enroll", "", alice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var enrollment auth.TOTPEnrollmentResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &enrollment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/svmmgr:alice?") || !strings.Contains(enrollment.URI, "secret="+enrollment.Secret) {
+		t.Errorf("unexpected enrollment: %+v", enrollment)
+	}
+	code := func(offset time.Duration) string {
+		t.Helper()
+		c, err := auth.TOTPCode(enrollment.Secret, time.Now().Add(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	if rec := doRequest(e, http.MethodPost, "/api/2fa/verify", `{"code":"000000x"}`, alice); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	rec = doRequest(e, http.MethodPost, "/api/2fa/verify", `{"code":"`+code(0)+`"}`, alice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var recovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &recovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(recovery.RecoveryCodes) != auth.RecoveryCodeCount {
+		t.Fatalf("unexpected recovery codes: %v", recovery.RecoveryCodes)
+	}
+
+	// パスワードだけではリフレッシュトークンを発行しない
+	passwordLogin := func(username string) auth.LoginChallengeResponse {
+		t.Helper()
+		rec := doRequest(e, http.MethodPost, "/auth/login", `{"username":"`+username+`","password":"password"}`, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("login failed: %d %s", rec.Code, rec.Body.String())
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Fatal("refresh token issued before second factor")
+		}
+		var ch auth.LoginChallengeResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &ch); err != nil {
+			t.Fatal(err)
+		}
+		if !ch.TwoFactorRequired || ch.Challenge == "" {
+			t.Fatalf("unexpected login response: %s", rec.Body.String())
+		}
+		return ch
+	}
+	ch := passwordLogin("alice")
+	if ch.EnrollmentRequired {
+		t.Error("enrollment should not be required")
+	}
+	// 登録時に使ったコードは再利用できない
+	if rec := doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","code":"`+code(0)+`"}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused code: unexpected status: %d", rec.Code)
+	}
+	rec = doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","code":"`+code(auth.TOTPPeriod)+`"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	h := accessHeader(t, e, rec)
+	if rec := doRequest(e, http.MethodGet, "/api/profile", "", h); rec.Code != http.StatusOK {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+	// チャレンジは1度しか使えない
+	if rec := doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","code":"`+code(-auth.TOTPPeriod)+`"}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused challenge: unexpected status: %d", rec.Code)
+	}
+
+	// リカバリーコードは1度だけ使える
+	ch = passwordLogin("alice")
+	rec = doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","recovery_code":"`+recovery.RecoveryCodes[0]+`"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	ch = passwordLogin("alice")
+	if rec := doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","recovery_code":"`+recovery.RecoveryCodes[0]+`"}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("reused recovery code: unexpected status: %d", rec.Code)
+	}
+
+	// 試行回数を超えたチャレンジは正しいコードでも使えない
+	ch = passwordLogin("alice")
+	for range 5 {
+		doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","code":"000000"}`, nil)
+	}
+	if rec := doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","recovery_code":"`+recovery.RecoveryCodes[1]+`"}`, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("too many attempts: unexpected status: %d", rec.Code)
+	}
+
+	// リカバリーコードを作り直すと古いコードは使えない
+	rec = doRequest(e, http.MethodPost, "/api/2fa/recovery-codes", `{"recovery_code":"`+recovery.RecoveryCodes[1]+`"}`, alice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	old := slices.Clone(recovery.RecoveryCodes)
+	if err := json.Unmarshal(rec.Body.Bytes(), &recovery); err != nil {
+		t.Fatal(err)
+	}
+	if rec := doRequest(e, http.MethodDelete, "/api/2fa", `{"recovery_code":"`+old[2]+`"}`, alice); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old recovery code: unexpected status: %d", rec.Code)
+	}
+
+	// 組織で必須にするとログイン中に登録させる
+	bob := login(t, e, "bob", "password")
+	if rec := doRequest(e, http.MethodPut, "/api/organization/two-factor", `{"required":true}`, bob); rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	ch = passwordLogin("bob")
+	if !ch.EnrollmentRequired {
+		t.Fatal("enrollment should be required")
+	}
+	rec = doRequest(e, http.MethodPost, "/auth/login/2fa/enroll", `{"challenge":"`+ch.Challenge+`"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var bobEnrollment auth.TOTPEnrollmentResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &bobEnrollment); err != nil {
+		t.Fatal(err)
+	}
+	bobCode, err := auth.TOTPCode(bobEnrollment.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = doRequest(e, http.MethodPost, "/auth/login/2fa", `{"challenge":"`+ch.Challenge+`","code":"`+bobCode+`"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	var bobRecovery struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &bobRecovery); err != nil {
+		t.Fatal(err)
+	}
+	if len(bobRecovery.RecoveryCodes) != auth.RecoveryCodeCount {
+		t.Errorf("unexpected recovery codes: %v", bobRecovery.RecoveryCodes)
+	}
+	bob = accessHeader(t, e, rec)
+	if rec := doRequest(e, http.MethodDelete, "/api/2fa", `{"recovery_code":"`+bobRecovery.RecoveryCodes[0]+`"}`, bob); rec.Code != http.StatusConflict {
+		t.Errorf("required by organization: unexpected status: %d", rec.Code)
+	}
+
+	// 必須でなければ無効にでき、パスワードだけでログインできるようになる
+	if rec := doRequest(e, http.MethodDelete, "/api/2fa", `{"recovery_code":"`+bobRecovery.RecoveryCodes[0]+`"}`, alice); rec.Code != http.StatusUnauthorized {
+		t.Errorf("other user's recovery code: unexpected status: %d", rec.Code)
+	}
+	if rec := doRequest(e, http.MethodDelete, "/api/2fa", `{"recovery_code":"`+recovery.RecoveryCodes[0]+`"}`, alice); rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status: %d %s", rec.Code, rec.Body.String())
+	}
+	login(t, e, "alice", "password")
+}
+
+// fakeIdP はテスト用のOpenID ConnectのIdP
+type fakeIdP struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeIdPCode
+}
+
+type fakeIdPCode struct {
+	challenge string // PKCEのcode_challenge
+	claims    jwt.MapClaims
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &fakeIdP{key: key, codes: make(map[string]fakeIdPCode)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                                idp.URL,
+			"authorization_endpoint":                idp.URL + "/authorize",
+			"token_endpoint":                        idp.URL + "/token",
+			"jwks_uri":                              idp.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		code, ok := idp.codes[r.FormValue("code")]
+		delete(idp.codes, r.FormValue("code"))
+		idp.mu.Unlock()
+		sum := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != code.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, code.claims)
+		token.Header["kid"] = "test"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+	return idp
+}
+
+// login はログインを開始し、IdPで認証された体でコールバックを呼び出す
+func (idp *fakeIdP) login(t *testing.T, e *echo.Echo, sub, username string, groups ...string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	rec := doRequest(e, http.MethodGet, "/auth/oidc/login", "", nil)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("oidc login failed: %d %s", rec.Code, rec.Body.String())
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := location.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("PKCE is not used: %s", location)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	code := "code-" + sub + "-" + q.Get("state")
+	idp.mu.Lock()
+	idp.codes[code] = fakeIdPCode{challenge: q.Get("code_challenge"), claims: jwt.MapClaims{
+		"iss":                idp.URL,
+		"aud":                q.Get("client_id"),
+		"sub":                sub,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              q.Get("nonce"),
+		"preferred_username": username,
+		"groups":             groups,
+	}}
+	idp.mu.Unlock()
+
+	callback := "/auth/oidc/callback?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	return doRequest(e, http.MethodGet, callback, "", http.Header{"Cookie": {cookie.Name + "=" + cookie.Value}})
+}
+
+func TestOIDC(t *testing.T) {
+	e, _ := setupTest(t)
+	idp := newFakeIdP(t)
+	conf.OIDC.Issuer = idp.URL
+	conf.OIDC.ClientID = "svmmgr"
+	conf.OIDC.RedirectURL = "https://vmmgr.example.com/auth/oidc/callback"
+	conf.OIDC.UsernameClaim = "preferred_username"
+	conf.OIDC.GroupsClaim = "groups"
+	conf.OIDC.AutoProvision = true
+	conf.OIDC.SuccessURL = "/"
+	conf.OIDC.GroupMappings = []config.GroupMapping{
+		{Group: "infra", Organization: 1, Role: "admin"},
+		{Group: "dev", Organization: 2, Role: "viewer"},
+		{Group: "ops", Organization: 2, Role: "operator"},
+	}
+	var err error
+	oidcProvider, err = newOIDC(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { oidcProvider = nil })
+
+	// 新しいユーザを作成し、グループに対応する組織と役割を設定する
+	rec := idp.login(t, e, "sub-carol", "carol", "infra", "dev", "ops", "unknown")
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/" {
+		t.Fatalf("oidc callback failed: %d %s", rec.Code, rec.Body.String())
+	}
+	h := accessHeader(t, e, rec)
+	var carol model.User
+	if err := db.Where("username = ?", "carol").First(&carol).Error; err != nil {
+		t.Fatal(err)
+	}
+	if carol.OrganizationID != 1 || carol.Role != model.RoleAdmin || carol.Password != "" {
+		t.Errorf("unexpected user: %+v", carol)
+	}
+	var m model.Membership
+	if err := db.Where("user_id = ? AND organization_id = ?", carol.ID, 2).First(&m).Error; err != nil || m.Role != model.RoleOperator {
+		t.Errorf("membership: %+v %v", m, err)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/orgs", "", h); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"org2"`) {
+		t.Errorf("orgs: %d %s", rec.Code, rec.Body.String())
+	}
+	// パスワードではログインできない
+	if rec := doRequest(e, http.MethodPost, "/auth/login", `{"username":"carol","password":""}`, nil); rec.Code == http.StatusOK {
+		t.Errorf("password login of OIDC user succeeded")
+	}
+
+	// グループから外れると組織から外れ、既定の組織も移る
+	rec = idp.login(t, e, "sub-carol", "carol", "dev")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("oidc callback failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := db.First(&carol, carol.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if carol.OrganizationID != 2 || carol.Role != model.RoleViewer {
+		t.Errorf("unexpected user after sync: %+v", carol)
+	}
+	var count int64
+	db.Model(&model.Membership{}).Where("user_id = ?", carol.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("memberships = %d, want 0", count)
+	}
+
+	// 既存のユーザには設定で有効にした場合のみユーザ名で紐付ける
+	frank := model.User{Username: "frank", OrganizationID: 1, Role: model.RoleViewer}
+	if err := db.Create(&frank).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rec := idp.login(t, e, "sub-frank", "frank", "infra"); rec.Code != http.StatusForbidden {
+		t.Errorf("link disabled: %d %s", rec.Code, rec.Body.String())
+	}
+	conf.OIDC.LinkExistingUsers = true
+	rec = idp.login(t, e, "sub-frank", "frank", "infra")
+	if rec.Code != http.StatusFound {
+		t.Fatalf("oidc callback failed: %d %s", rec.Code, rec.Body.String())
+	}
+	if err := db.First(&frank, frank.ID).Error; err != nil || frank.OIDCSubject == nil || *frank.OIDCSubject != "sub-frank" {
+		t.Errorf("frank is not linked: %+v %v", frank, err)
+	}
+	// 別のIdPのユーザが同じユーザ名でも紐付けない
+	if rec := idp.login(t, e, "sub-other", "frank", "infra"); rec.Code != http.StatusForbidden {
+		t.Errorf("other subject: %d %s", rec.Code, rec.Body.String())
+	}
+	// パスワードを持つローカルのユーザは乗っ取れない
+	if rec := idp.login(t, e, "sub-mallory", "alice", "infra"); rec.Code != http.StatusForbidden {
+		t.Errorf("takeover of local user: %d %s", rec.Code, rec.Body.String())
+	}
+	var alice model.User
+	if err := db.First(&alice, 1).Error; err != nil || alice.OIDCSubject != nil {
+		t.Errorf("alice is linked: %+v %v", alice, err)
+	}
+	// LDAPのユーザにも紐付けない
+	dn := "uid=heidi,ou=people,dc=example,dc=com"
+	if err := db.Create(&model.User{Username: "heidi", OrganizationID: 1, Role: model.RoleViewer, LDAPDN: &dn}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if rec := idp.login(t, e, "sub-heidi", "heidi", "infra"); rec.Code != http.StatusForbidden {
+		t.Errorf("link to LDAP user: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// 対応するグループが無い場合はログインできない
+	if rec := idp.login(t, e, "sub-dave", "dave", "unknown"); rec.Code != http.StatusForbidden {
+		t.Errorf("unmapped groups: %d %s", rec.Code, rec.Body.String())
+	}
+	// 自動作成しない設定では存在しないユーザはログインできない
+	conf.OIDC.AutoProvision = false
+	if rec := idp.login(t, e, "sub-erin", "erin", "infra"); rec.Code != http.StatusForbidden {
+		t.Errorf("auto provision disabled: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// stateがクッキーと一致しない
+	rec = doRequest(e, http.MethodGet, "/auth/oidc/login", "", nil)
+	cookie := rec.Result().Cookies()[0]
+	rec = doRequest(e, http.MethodGet, "/auth/oidc/callback?code=x&state=forged", "", http.Header{"Cookie": {cookie.Name + "=" + cookie.Value}})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("forged state: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestLDAP(t *testing.T) {
+	e, _ := setupTest(t)
+	fake, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+	fake.AddEntry(ldaptest.Entry{DN: "cn=svc,dc=example,dc=com", Password: "svc-secret"})
+	for _, entry := range []struct {
+		uid, password string
+		groups        []string
+	}{
+		// DNの大文字小文字は区別しない
+		{"carol", "carol-secret", []string{"cn=infra,ou=groups,dc=example,dc=com", "CN=Dev,OU=Groups,DC=example,DC=com"}},
+		{"alice", "ldap-secret", []string{"cn=infra,ou=groups,dc=example,dc=com"}},
+		{"dave", "dave-secret", []string{"cn=unknown,ou=groups,dc=example,dc=com"}},
+		{"grace", "grace-secret", []string{"cn=infra,ou=groups,dc=example,dc=com"}},
+	} {
+		fake.AddEntry(ldaptest.Entry{
+			DN:       "uid=" + entry.uid + ",ou=people,dc=example,dc=com",
+			Password: entry.password,
+			Attributes: map[string][]string{
+				"objectClass": {"person"},
+				"uid":         {entry.uid},
+				"memberOf":    entry.groups,
+			},
+		})
+	}
+
+	conf.LDAP.URL = fake.URL()
+	conf.LDAP.BindDN = "cn=svc,dc=example,dc=com"
+	conf.LDAP.BindPassword = "svc-secret"
+	conf.LDAP.BaseDN = "dc=example,dc=com"
+	conf.LDAP.UserFilter = "(&(objectClass=person)(uid=%s))"
+	conf.LDAP.GroupAttribute = "memberOf"
+	conf.LDAP.Timeout = time.Second
+	conf.LDAP.GroupMappings = []config.GroupMapping{
+		{Group: "cn=infra,ou=groups,dc=example,dc=com", Organization: 1, Role: "operator"},
+		{Group: "cn=dev,ou=groups,dc=example,dc=com", Organization: 2, Role: "viewer"},
+	}
+	authenticator, err = newAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 初回のログインでユーザを作成し、グループに対応する組織と役割を設定する
+	h := login(t, e, "carol", "carol-secret")
+	var carol model.User
+	if err := db.Where("username = ?", "carol").First(&carol).Error; err != nil {
+		t.Fatal(err)
+	}
+	if carol.OrganizationID != 1 || carol.Role != model.RoleOperator || carol.Password != "" || carol.LDAPDN == nil || *carol.LDAPDN != "uid=carol,ou=people,dc=example,dc=com" {
+		t.Errorf("unexpected user: %+v", carol)
+	}
+	var m model.Membership
+	if err := db.Where("user_id = ? AND organization_id = ?", carol.ID, 2).First(&m).Error; err != nil || m.Role != model.RoleViewer {
+		t.Errorf("membership: %+v %v", m, err)
+	}
+	if rec := doRequest(e, http.MethodGet, "/api/server/1", "", h); rec.Code != http.StatusOK {
+		t.Errorf("get server: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// 2回目以降は同じユーザでログインする
+	login(t, e, "carol", "carol-secret")
+	var count int64
+	db.Model(&model.User{}).Where("username = ?", "carol").Count(&count)
+	if count != 1 {
+		t.Errorf("users named carol = %d, want 1", count)
+	}
+
+	// OIDCで作成された同じユーザ名のユーザはLDAPのユーザとして扱わない
+	subject := "sub-grace"
+	grace := model.User{Username: "grace", OrganizationID: 2, Role: model.RoleViewer, OIDCSubject: &subject}
+	if err := db.Create(&grace).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		username, password string
+		code               int
+	}{
+		{"carol", "wrong", http.StatusUnauthorized},
+		{"grace", "grace-secret", http.StatusForbidden},
+		{"alice", "ldap-secret", http.StatusUnauthorized}, // ローカルのユーザはLDAPのパスワードではログインできない
+		{"dave", "dave-secret", http.StatusForbidden},     // 対応するグループが無い
+		{"erin", "erin-secret", http.StatusUnauthorized},
+	} {
+		rec := doRequest(e, http.MethodPost, "/auth/login", `{"username":"`+tc.username+`","password":"`+tc.password+`"}`, nil)
+		if rec.Code != tc.code {
+			t.Errorf("login %s: %d %s, want %d", tc.username, rec.Code, rec.Body.String(), tc.code)
+		}
+	}
+	// ローカルのパスワードは引き続き使える
+	login(t, e, "alice", "password")
+	if err := db.First(&grace, grace.ID).Error; err != nil || grace.OrganizationID != 2 || grace.Role != model.RoleViewer || grace.LDAPDN != nil {
+		t.Errorf("OIDC user was modified: %+v %v", grace, err)
+	}
+
+	// LDAPに接続できない場合
+	fake.Close()
+	if rec := doRequest(e, http.MethodPost, "/auth/login", `{"username":"carol","password":"carol-secret"}`, nil); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("LDAP unavailable: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	e, _ := setupTest(t)
+
+	rec := doRequest(e, http.MethodPost, "/auth/login", `{"username":"alice","password":"password"}`, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login failed: %d %s", rec.Code, rec.Body.String())
+	}
+	refreshCookie := func(rec *httptest.ResponseRecorder) string {
+		t.Helper()
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == auth.CookieName {
+				return c.Value
+			}
+		}
+		t.Fatalf("no refresh token cookie: %d %s", rec.Code, rec.Body.String())
+		return ""
+	}
+	refresh := func(token string) *httptest.ResponseRecorder {
+		return doRequest(e, http.MethodGet, "/auth/refresh", "", http.Header{"Cookie": {auth.CookieName + "=" + token}})
+	}
+	first := refreshCookie(rec)
+
+	// リフレッシュの度に同じファミリーの新しいトークンに置き換わる
+	rec = refresh(first)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("refresh failed: %d %s", rec.Code, rec.Body.String())
+	}
+	second := refreshCookie(rec)
+	if second == first {
+		t.Fatal("refresh token was not rotated")
+	}
+	var tokens []model.RefreshToken
+	db.Order("id").Find(&tokens)
+	if len(tokens) != 2 || tokens[0].Family == "" || tokens[0].Family != tokens[1].Family || tokens[0].RotatedAt == nil || tokens[1].RotatedAt != nil {
+		t.Fatalf("unexpected tokens: %+v", tokens)
+	}
+	// アクセストークンにリフレッシュトークンは含めない
+	if strings.Contains(rec.Body.String(), second) {
+		t.Error("access token contains the refresh token")
+	}
+
+	// ローテーションの直後 (複数のタブからの同時のリフレッシュなど) はファミリーを失効しないが、トークンも発行しない
+	rec = refresh(first)
+	if rec.Code != http.StatusConflict || len(rec.Result().Cookies()) != 0 || strings.Contains(rec.Body.String(), "access_token") {
+		t.Fatalf("refresh within reuse interval: %d %s", rec.Code, rec.Body.String())
+	}
+
+	h := accessHeader(t, e, refresh(second))
+	var current model.RefreshToken
+	if err := db.Where("rotated_at IS NULL").First(&current).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(e)
+	defer ts.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws/server/3/console?ticket="+consoleTicket(t, e, h, "3"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte("ls\r")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	// しばらく経ってからローテーション済みのトークンが使われた場合は盗用とみなしてファミリーを失効する
+	db.Model(&model.RefreshToken{}).Where("token = ?", first).UpdateColumn("rotated_at", time.Now().Add(-time.Minute))
+	if rec := refresh(first); rec.Code != http.StatusBadRequest {
+		t.Fatalf("reused token: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := refresh(current.Token); rec.Code != http.StatusBadRequest {
+		t.Errorf("token in revoked family: %d %s", rec.Code, rec.Body.String())
+	}
+	var count int64
+	db.Model(&model.RefreshToken{}).Count(&count)
+	if count != 0 {
+		t.Errorf("refresh tokens = %d, want 0", count)
+	}
+	// ファミリーで開始したコンソールセッションも切断される
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			var ce *websocket.CloseError
+			if !errors.As(err, &ce) || ce.Text != "refresh token reuse detected" {
+				t.Errorf("unexpected close: %v", err)
+			}
+			break
+		}
+	}
+
+	// 他のログインには影響しない
+	login(t, e, "alice", "password")
+}
+
+func TestSessions(t *testing.T) {
+	e, _ := setupTest(t)
+	hash, err := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol := &model.User{Username: "carol", Password: string(hash), OrganizationID: 1, Role: model.RoleViewer}
+	if err := db.Create(carol).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// loginFrom はブラウザと同じくリフレッシュにも同じUser-Agentを付ける
+	loginFrom := func(username, userAgent string) (string, http.Header) {
+		t.Helper()
+		rec := doRequest(e, http.MethodPost, "/auth/login", `{"username":"`+username+`","password":"password"}`, http.Header{"User-Agent": {userAgent}})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("login failed: %d %s", rec.Code, rec.Body.String())
+		}
+		var cookie string
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == auth.CookieName {
+				cookie = c.Value
+			}
+		}
+		rec = doRequest(e, http.MethodGet, "/auth/refresh", "", http.Header{"Cookie": {auth.CookieName + "=" + cookie}, "User-Agent": {userAgent}})
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &token); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("refresh failed: %d %s", rec.Code, rec.Body.String())
+		}
+		return cookie, http.Header{"Authorization": {"Bearer " + token.AccessToken}}
+	}
+	listSessions := func(h http.Header, path string) []sessionResponse {
+		t.Helper()
+		rec := doRequest(e, http.MethodGet, path, "", h)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: %d %s", path, rec.Code, rec.Body.String())
+		}
+		var res []sessionResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	_, laptop := loginFrom("alice", "laptop")
+	phoneCookie, _ := loginFrom("alice", "phone")
+
+	// ローテーション済みのトークンは一覧に含めない
+	res := listSessions(laptop, "/api/sessions")
+	if len(res) != 2 || res[0].UserAgent != "phone" || res[0].Current || res[1].UserAgent != "laptop" || !res[1].Current {
+		t.Fatalf("sessions = %+v", res)
+	}
+	if res[1].IPAddress == "" || res[1].CreatedAt.IsZero() || res[1].LastUsedAt.Before(res[1].CreatedAt) {
+		t.Errorf("session = %+v", res[1])
+	}
+
+	// 他のセッションをログアウトさせると、そのセッションはリフレッシュできない
+	if rec := doRequest(e, http.MethodDelete, fmt.Sprintf("/api/sessions/%d", res[0].ID), "", laptop); rec.Code != http.StatusOK {
+		t.Fatalf("delete session: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(e, http.MethodGet, "/auth/refresh", "", http.Header{"Cookie": {auth.CookieName + "=" + phoneCookie}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("refresh revoked session: %d %s", rec.Code, rec.Body.String())
+	}
+	if res := listSessions(laptop, "/api/sessions"); len(res) != 1 || !res[0].Current {
+		t.Errorf("sessions after revoke = %+v", res)
+	}
+
+	// 管理者は組織のユーザのセッションを管理できる
+	_, carolHeader := loginFrom("carol", "tablet")
+	bob := login(t, e, "bob", "password")
+	carolPath := fmt.Sprintf("/api/users/%d/sessions", carol.ID)
+	carolSessions := listSessions(laptop, carolPath)
+	if len(carolSessions) != 1 || carolSessions[0].UserAgent != "tablet" || carolSessions[0].Current {
+		t.Fatalf("carol sessions = %+v", carolSessions)
+	}
+	// alice のセッションは carol のセッションとして失効できない
+	aliceSessions := listSessions(laptop, "/api/sessions")
+	for _, tt := range []struct {
+		header http.Header
+		method string
+		path   string
+		want   int
+	}{
+		{carolHeader, http.MethodGet, "/api/users/1/sessions", http.StatusForbidden},
+		{bob, http.MethodGet, carolPath, http.StatusNotFound},
+		{bob, http.MethodDelete, carolPath, http.StatusNotFound},
+		{laptop, http.MethodDelete, fmt.Sprintf("%s/%d", carolPath, aliceSessions[0].ID), http.StatusNotFound},
+		{carolHeader, http.MethodDelete, fmt.Sprintf("/api/sessions/%d", aliceSessions[0].ID), http.StatusNotFound},
+	} {
+		if rec := doRequest(e, tt.method, tt.path, "", tt.header); rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, rec.Code, tt.want)
+		}
+	}
+	if rec := doRequest(e, http.MethodDelete, fmt.Sprintf("%s/%d", carolPath, carolSessions[0].ID), "", laptop); rec.Code != http.StatusOK {
+		t.Fatalf("delete carol session: %d %s", rec.Code, rec.Body.String())
+	}
+
+	// 管理していない組織にも所属するユーザのセッションは管理できない
+	dave := &model.User{Username: "dave", Password: string(hash), OrganizationID: 2, Role: model.RoleViewer}
+	if err := db.Create(dave).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&model.Membership{UserID: dave.ID, OrganizationID: 1, Role: model.RoleViewer}).Error; err != nil {
+		t.Fatal(err)
+	}
+	davePath := fmt.Sprintf("/api/users/%d/sessions", dave.ID)
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		if rec := doRequest(e, method, davePath, "", laptop); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s: status = %d, want %d", method, davePath, rec.Code, http.StatusForbidden)
+		}
+	}
+	// 全ての組織の管理者であれば管理できる
+	if err := db.Create(&model.Membership{UserID: 1, OrganizationID: 2, Role: model.RoleAdmin}).Error; err != nil {
+		t.Fatal(err)
+	}
+	listSessions(laptop, davePath)
+	var count int64
+	db.Model(&model.RefreshToken{}).Where("user_id = ?", carol.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("carol refresh tokens = %d, want 0", count)
+	}
+
+	// 全てのセッションからログアウトする
+	loginFrom("alice", "desktop")
+	if rec := doRequest(e, http.MethodDelete, "/api/sessions", "", laptop); rec.Code != http.StatusOK {
+		t.Fatalf("logout everywhere: %d %s", rec.Code, rec.Body.String())
+	}
+	db.Model(&model.RefreshToken{}).Where("user_id = 1").Count(&count)
+	if count != 0 {
+		t.Errorf("alice refresh tokens = %d, want 0", count)
+	}
+	// 他のユーザのセッションには影響しない
+	if res := listSessions(bob, "/api/sessions"); len(res) != 1 {
+		t.Errorf("bob sessions = %+v", res)
+	}
+
+	// 期限切れのトークンを削除する
+	db.Create(&model.RefreshToken{Token: "expired", UserID: 2, ExpiresAt: time.Now().Add(-time.Minute)})
+	if n, err := auth.PurgeExpiredRefreshTokens(db); err != nil || n != 1 {
+		t.Errorf("PurgeExpiredRefreshTokens = %d, %v", n, err)
+	}
+	db.Model(&model.RefreshToken{}).Count(&count)
+	if count != 2 { // bob のセッション (ローテーション済みのトークンを含む)
+		t.Errorf("refresh tokens = %d, want 2", count)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// oidcProvider はOpenID Connectの設定がある場合のみ設定される
+var oidcProvider *auth.OIDC
+
+// newOIDC は設定からOpenID Connectのログインを準備する
+func newOIDC(ctx context.Context) (*auth.OIDC, error) {
+	if err := validateGroupMappings("OIDC.GroupMappings", conf.OIDC.GroupMappings); err != nil {
+		return nil, err
+	}
+	return auth.NewOIDC(ctx, auth.OIDCConfig{
+		Issuer:        conf.OIDC.Issuer,
+		ClientID:      conf.OIDC.ClientID,
+		ClientSecret:  conf.OIDC.ClientSecret,
+		RedirectURL:   conf.OIDC.RedirectURL,
+		Scopes:        conf.OIDC.Scopes,
+		UsernameClaim: conf.OIDC.UsernameClaim,
+		GroupsClaim:   conf.OIDC.GroupsClaim,
+	})
+}
+
+// oidcLoginHandler はIdPの認可エンドポイントにリダイレクトする
+func oidcLoginHandler(c echo.Context) error {
+	if oidcProvider == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "OIDC is not configured")
+	}
+	url, err := oidcProvider.Begin(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to start OIDC login")
+	}
+	return c.Redirect(http.StatusFound, url)
+}
+
+// oidcCallbackHandler はIdPからのリダイレクトを受け取り、ユーザを作成・同期してRefreshトークンを発行する
+// 二段階認証はIdPで行われるものとしてTOTPは要求しない
+func oidcCallbackHandler(c echo.Context) error {
+	if oidcProvider == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "OIDC is not configured")
+	}
+	identity, err := oidcProvider.Finish(c)
+	if err != nil {
+		if errors.Is(err, auth.ErrInvalidOIDCState) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid OIDC state")
+		}
+		log.Println("OIDCの認証に失敗:", err)
+		return echo.NewHTTPError(http.StatusUnauthorized, "OIDC authentication failed")
+	}
+
+	user, err := oidcUser(identity)
+	if err != nil {
+		var denied auth.AccessDeniedError
+		if errors.As(err, &denied) {
+			return echo.NewHTTPError(http.StatusForbidden, denied.Error())
+		}
+		log.Println("OIDCのユーザの同期に失敗:", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	revalidateConsoleSessions(func(s *console.Session) bool { return s.UserID == user.ID }, "role changed")
+
+	if _, err := auth.GenerateRefreshToken(c, user.ID, db, conf.RefreshToken.Duration); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to generate refresh token")
+	}
+	return c.Redirect(http.StatusFound, conf.OIDC.SuccessURL)
+}
+
+// oidcUser はIdPのユーザに対応するユーザを返す
+// sub クレームで一致するユーザが無い場合、LinkExistingUsers が有効ならパスワードを持たないユーザ (LDAPのユーザを除く) にユーザ名で紐付け、
+// ユーザ名が一致するユーザも無い場合は AutoProvision が有効なら作成する
+// 所属する組織と役割はグループの対応に従って同期する
+func oidcUser(identity *auth.OIDCIdentity) (*model.User, error) {
+	roles := mappedRoles(conf.OIDC.GroupMappings, identity.Groups)
+	if len(roles) == 0 {
+		return nil, auth.AccessDeniedError("No organization is mapped to the user's groups")
+	}
+
+	var user model.User
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("oidc_subject = ?", identity.Subject).First(&user).Error
+		if err == nil {
+			return syncMemberships(tx, &user, roles)
+		}
+		if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		if identity.Username == "" {
+			return auth.AccessDeniedError("Username claim is missing")
+		}
+		err = tx.Where("username = ?", identity.Username).First(&user).Error
+		switch {
+		case err == nil:
+			// ユーザ名のクレームは利用者が変更できる場合があるため、ローカルのユーザを乗っ取れないようにする
+			if user.OIDCSubject != nil {
+				return auth.AccessDeniedError("User is linked to another OIDC account")
+			}
+			if !conf.OIDC.LinkExistingUsers || user.Password != "" || user.LDAPDN != nil {
+				log.Printf("OIDCのユーザ %q (sub=%s) を既存のユーザに紐付けない", identity.Username, identity.Subject)
+				return auth.AccessDeniedError("User already exists and is not linked to this OIDC account")
+			}
+			if err := tx.Model(&user).Update("oidc_subject", identity.Subject).Error; err != nil {
+				return err
+			}
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			if !conf.OIDC.AutoProvision {
+				return auth.AccessDeniedError("User is not provisioned")
+			}
+			// パスワードは設定しないため、パスワードではログインできない
+			subject := identity.Subject
+			orgID := firstOrganization(roles)
+			user = model.User{
+				Username:       identity.Username,
+				OrganizationID: orgID,
+				Role:           roles[orgID],
+				OIDCSubject:    &subject,
+			}
+			if err := tx.Create(&user).Error; err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+		return syncMemberships(tx, &user, roles)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
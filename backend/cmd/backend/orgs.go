@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/config"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// organizationHeader はリクエストの対象とする組織を指定するヘッダ
+const organizationHeader = "X-Organization-ID"
+
+// activeOrganizationID はリクエストで選択された組織のIDを返す
+// パス (/api/orgs/:org/...) またはヘッダで指定し、指定が無い場合は 0 を返す
+func activeOrganizationID(c echo.Context) (uint64, error) {
+	value := c.Param("org")
+	if value == "" {
+		value = c.Request().Header.Get(organizationHeader)
+	}
+	if value == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || id == 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid Organization ID format")
+	}
+	return id, nil
+}
+
+// asMember はユーザを組織のメンバーとして扱うコピーを返す
+// OrganizationID、Role、Restricted はその組織でのものになる
+// user はDBから取得したままのもので、所属していない組織の場合は nil を返す
+func asMember(user *model.User, organizationID uint64) (*model.User, error) {
+	if user.OrganizationID == organizationID {
+		return user, nil
+	}
+	var m model.Membership
+	if err := db.Where("user_id = ? AND organization_id = ?", user.ID, organizationID).First(&m).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	member := *user
+	member.OrganizationID = m.OrganizationID
+	member.Role = m.Role
+	member.Restricted = m.Restricted
+	return &member, nil
+}
+
+// orgMember は組織のメンバーであるユーザを返す
+func orgMember(organizationID, userID uint64) (*model.User, error) {
+	var user model.User
+	if err := db.First(&user, userID).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return nil, echo.NewHTTPError(http.StatusNotFound, "User not found")
+		}
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	member, err := asMember(&user, organizationID)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if member == nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+	return member, nil
+}
+
+// orgMembers は組織のメンバーの一覧をユーザID順に返す
+func orgMembers(organizationID uint64) ([]model.User, error) {
+	var users []model.User
+	if err := db.Where("organization_id = ?", organizationID).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	var memberships []model.Membership
+	if err := db.Where("organization_id = ?", organizationID).Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	for _, m := range memberships {
+		var user model.User
+		if err := db.First(&user, m.UserID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				continue
+			}
+			return nil, err
+		}
+		user.OrganizationID = m.OrganizationID
+		user.Role = m.Role
+		user.Restricted = m.Restricted
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+// updateMember は組織でのユーザの役割などを更新する
+// 既定の組織であればユーザを、それ以外であれば Membership を更新する
+func updateMember(tx *gorm.DB, member *model.User, column string, value any) error {
+	res := tx.Model(&model.Membership{}).Where("user_id = ? AND organization_id = ?", member.ID, member.OrganizationID).Update(column, value)
+	if res.Error != nil || res.RowsAffected > 0 {
+		return res.Error
+	}
+	return tx.Model(&model.User{}).Where("id = ? AND organization_id = ?", member.ID, member.OrganizationID).Update(column, value).Error
+}
+
+type organizationResponse struct {
+	model.Organization
+	Role       model.Role `json:"role"`       // 組織での役割
+	Restricted bool       `json:"restricted"` // 権限を付与されたサーバのみ操作できるか
+	Default    bool       `json:"default"`    // 組織を指定しない場合に使われる組織か
+}
+
+// getOrganizationsHandler は自分が所属する組織の一覧を返す
+func getOrganizationsHandler(c echo.Context) error {
+	userID, err := auth.UserID(c)
+	if err != nil || userID == nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Unauthorized")
+	}
+	var user model.User
+	if err := db.First(&user, *userID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "User not found")
+	}
+
+	var memberships []model.Membership
+	if err := db.Where("user_id = ?", user.ID).Order("organization_id").Find(&memberships).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	memberships = append([]model.Membership{{
+		UserID:         user.ID,
+		OrganizationID: user.OrganizationID,
+		Role:           user.Role,
+		Restricted:     user.Restricted,
+	}}, memberships...)
+
+	resp := make([]organizationResponse, 0, len(memberships))
+	for _, m := range memberships {
+		var org model.Organization
+		if err := db.First(&org, m.OrganizationID).Error; err != nil {
+			if err == gorm.ErrRecordNotFound {
+				continue
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+		}
+		resp = append(resp, organizationResponse{
+			Organization: org,
+			Role:         m.Role,
+			Restricted:   m.Restricted,
+			Default:      m.OrganizationID == user.OrganizationID,
+		})
+	}
+	return c.JSON(http.StatusOK, resp)
+}
+
+// validateGroupMappings は外部の認証基盤のグループと組織・役割の対応を確認する
+func validateGroupMappings(name string, mappings []config.GroupMapping) error {
+	for _, m := range mappings {
+		if !model.Role(m.Role).Valid() {
+			return errors.New(name + ": invalid role " + m.Role)
+		}
+		if m.Organization == 0 {
+			return errors.New(name + ": organization is required for group " + m.Group)
+		}
+	}
+	return nil
+}
+
+// mappedRoles は外部の認証基盤のグループから組織ごとの役割を求める
+// グループ名はLDAPのDNのため大文字小文字を区別しない
+// 複数のグループが同じ組織に対応する場合は権限の多い役割を使う
+func mappedRoles(mappings []config.GroupMapping, groups []string) map[uint64]model.Role {
+	roles := make(map[uint64]model.Role)
+	for _, m := range mappings {
+		if !slices.ContainsFunc(groups, func(g string) bool { return strings.EqualFold(g, m.Group) }) {
+			continue
+		}
+		role := model.Role(m.Role)
+		if cur, ok := roles[m.Organization]; !ok || len(role.Permissions()) > len(cur.Permissions()) {
+			roles[m.Organization] = role
+		}
+	}
+	return roles
+}
+
+// firstOrganization はIDが最も小さい組織を返す
+func firstOrganization(roles map[uint64]model.Role) uint64 {
+	var first uint64
+	for id := range roles {
+		if first == 0 || id < first {
+			first = id
+		}
+	}
+	return first
+}
+
+// syncMemberships はユーザの所属する組織と役割を外部の認証基盤のグループの対応に合わせる
+// 既定の組織が対応に無い場合は対応する組織のうち最初のものを既定の組織にする
+// Restricted は管理者が設定するものとして変更しない
+func syncMemberships(tx *gorm.DB, user *model.User, roles map[uint64]model.Role) error {
+	if _, ok := roles[user.OrganizationID]; !ok {
+		orgID := firstOrganization(roles)
+		var m model.Membership
+		restricted := false
+		if err := tx.Where("user_id = ? AND organization_id = ?", user.ID, orgID).First(&m).Error; err == nil {
+			restricted = m.Restricted
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+		user.OrganizationID = orgID
+		user.Restricted = restricted
+	}
+	user.Role = roles[user.OrganizationID]
+	err := tx.Model(user).Updates(map[string]any{
+		"organization_id": user.OrganizationID,
+		"role":            user.Role,
+		"restricted":      user.Restricted,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	orgIDs := make([]uint64, 0, len(roles))
+	for orgID, role := range roles {
+		orgIDs = append(orgIDs, orgID)
+		if orgID == user.OrganizationID {
+			continue
+		}
+		res := tx.Model(&model.Membership{}).Where("user_id = ? AND organization_id = ?", user.ID, orgID).Update("role", role)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			if err := tx.Create(&model.Membership{UserID: user.ID, OrganizationID: orgID, Role: role}).Error; err != nil {
+				return err
+			}
+		}
+	}
+	// 既定の組織の Membership と、対応から外れた組織の Membership を削除する
+	return tx.Unscoped().
+		Where("user_id = ? AND (organization_id = ? OR organization_id NOT IN ?)", user.ID, user.OrganizationID, orgIDs).
+		Delete(&model.Membership{}).Error
+}
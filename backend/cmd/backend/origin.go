@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// sameOrigin はリクエストのOriginがリクエスト先と同じホストかを返す
+// Originがない場合はブラウザ以外からのリクエストとして同一オリジンとみなす
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get(echo.HeaderOrigin)
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// checkWebSocketOrigin は同一オリジンか設定で許可されたオリジンからの接続のみ許可する
+func checkWebSocketOrigin(r *http.Request) bool {
+	if sameOrigin(r) {
+		return true
+	}
+	origin := r.Header.Get(echo.HeaderOrigin)
+	if conf.AllowOrigin(origin) {
+		return true
+	}
+	log.Printf("許可されていないオリジンからのWebSocket接続: origin=%s path=%s remote=%s", origin, r.URL.Path, r.RemoteAddr)
+	return false
+}
+
+// allowCORSOrigin はCORSで許可するオリジンかを返す
+func allowCORSOrigin(origin string) (bool, error) {
+	if conf.AllowOrigin(origin) {
+		return true, nil
+	}
+	log.Printf("許可されていないオリジンからのリクエスト: origin=%s", origin)
+	return false, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/model"
+)
+
+// 再生速度の上限
+const maxReplaySpeed = 64
+
+// activeRecording は録画中のVNCセッション
+type activeRecording struct {
+	*console.Recorder
+	row model.ConsoleRecording
+}
+
+type updateRecordingPolicyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// updateRecordingPolicyHandler は組織のVNCコンソールの操作を録画するかを変更する
+// 変更は次に開始するセッションから適用される
+func updateRecordingPolicyHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+	var req updateRecordingPolicyRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	var org model.Organization
+	if err := db.First(&org, user.OrganizationID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Organization not found")
+	}
+	if err := db.Model(&org).Update("record_console", req.Enabled).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return c.JSON(http.StatusOK, org)
+}
+
+// startRecording は組織で録画が有効な場合に録画を開始する
+// 録画しない場合は nil を返す
+func startRecording(user *model.User, sv *model.Server, sess *console.Session) (*activeRecording, error) {
+	var org model.Organization
+	if err := db.First(&org, sv.OrganizationID).Error; err != nil {
+		return nil, err
+	}
+	if !org.RecordConsole {
+		return nil, nil
+	}
+
+	path := filepath.Join(conf.Console.RecordingDir, strconv.FormatUint(org.ID, 10), sess.ID+".rec")
+	rec, err := console.CreateRecording(path)
+	if err != nil {
+		return nil, err
+	}
+
+	row := model.ConsoleRecording{
+		OrganizationID: org.ID,
+		ServerID:       sv.ID,
+		ServerName:     sv.Name,
+		UserID:         user.ID,
+		Username:       user.Username,
+		SessionID:      sess.ID,
+		Path:           path,
+		StartedAt:      sess.StartedAt,
+	}
+	if err := db.Create(&row).Error; err != nil {
+		rec.Close()
+		return nil, err
+	}
+	return &activeRecording{Recorder: rec, row: row}, nil
+}
+
+// finish は録画を終了して終了日時とサイズを記録する
+func (r *activeRecording) finish() {
+	if err := r.Close(); err != nil {
+		log.Println("録画の終了に失敗:", err)
+	}
+	now := time.Now()
+	if err := db.Model(&r.row).Updates(map[string]any{"ended_at": &now, "size": r.Size()}).Error; err != nil {
+		log.Println("録画の終了日時の保存に失敗:", err)
+	}
+}
+
+// getRecordingFromParam はパスパラメータのIDに対応する組織内の録画を返す
+func getRecordingFromParam(c echo.Context, user *model.User) (*model.ConsoleRecording, error) {
+	id := parseUintParam(c, "id")
+	if id == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid recording ID")
+	}
+
+	var rec model.ConsoleRecording
+	if err := db.Where("id = ? AND organization_id = ?", id, user.OrganizationID).First(&rec).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Recording not found")
+	}
+	return &rec, nil
+}
+
+// getRecordingsHandler は組織の録画の一覧を新しい順に返す
+// server_id を指定した場合はそのサーバの録画のみを返す
+func getRecordingsHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	q := db.Where("organization_id = ?", user.OrganizationID)
+	if s := c.QueryParam("server_id"); s != "" {
+		serverID, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid server ID")
+		}
+		q = q.Where("server_id = ?", serverID)
+	}
+
+	var list []model.ConsoleRecording
+	if err := q.Order("started_at DESC").Find(&list).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to get recordings")
+	}
+	return c.JSON(http.StatusOK, list)
+}
+
+// recordingTicketHandler は録画の再生用のチケットを発行する
+func recordingTicketHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+	rec, err := getRecordingFromParam(c, user)
+	if err != nil {
+		return err
+	}
+
+	ticket, expiresAt, err := tickets.Issue(auth.TicketReplay, user.ID, rec.ID, auth.TokenID(c))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to issue replay ticket")
+	}
+	return c.JSON(http.StatusOK, map[string]any{
+		"ticket":     ticket,
+		"expires_at": expiresAt.Unix(),
+	})
+}
+
+// replayRecordingHandler は録画をnoVNCクライアントに再生する
+// speed で再生速度の倍率を指定できる (既定は1)
+// クライアントからのメッセージは読み捨てる
+func replayRecordingHandler(c echo.Context) error {
+	ticket := c.QueryParam("ticket")
+	if ticket == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Ticket is required")
+	}
+
+	speed := 1.0
+	if s := c.QueryParam("speed"); s != "" {
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil || v <= 0 || v > maxReplaySpeed {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid speed")
+		}
+		speed = v
+	}
+
+	id := parseUintParam(c, "id")
+	var rec model.ConsoleRecording
+	if err := db.First(&rec, id).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Recording not found")
+	}
+
+	t, err := tickets.Redeem(ticket, auth.TicketReplay, rec.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid ticket")
+	}
+	var user model.User
+	if err := db.First(&user, t.UserID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "User not found")
+	}
+	member, err := asMember(&user, rec.OrganizationID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if member == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Recording not found")
+	}
+	if err := checkPermission(member, model.PermissionManage); err != nil {
+		return err
+	}
+
+	rr, err := console.OpenRecording(rec.Path)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to open recording")
+	}
+	defer rr.Close()
+
+	wsConn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to upgrade to WebSocket")
+	}
+	defer wsConn.Close()
+
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+
+	// クライアントからの入力は読み捨て、切断を検知する
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := wsConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	err = console.Replay(ctx, rr, speed, func(p []byte) error {
+		return wsConn.WriteMessage(websocket.BinaryMessage, p)
+	})
+	if err != nil && ctx.Err() == nil {
+		closeWebSocket(wsConn, websocket.CloseInternalServerErr, "replay failed")
+		return nil
+	}
+	closeWebSocket(wsConn, websocket.CloseNormalClosure, "replay finished")
+	return nil
+}
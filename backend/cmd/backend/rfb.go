@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// RFBのハンドシェイクでクライアントが送る内容
+const (
+	rfbStageVersion    = iota // ProtocolVersion (12バイト)
+	rfbStageSecurity          // 選択したセキュリティタイプ (1バイト)
+	rfbStageVNCAuth           // VNC認証のレスポンス (16バイト)
+	rfbStageClientInit        // ClientInit (1バイト)
+	rfbStageMessages          // ハンドシェイク以降のメッセージ
+)
+
+// rfbInputWriter はクライアントからVNCサーバへのRFBのストリームを解析し、
+// キーボードとマウスの操作だけを入力として数える
+// FramebufferUpdateRequest などクライアントが自動で送るメッセージは入力とみなさない
+// 解析できないストリームは全てを入力とみなす
+type rfbInputWriter struct {
+	w     io.Writer
+	input func(int) // キーボード・マウスの操作
+	other func(int) // それ以外
+
+	stage int
+	hdr   []byte // 長さが決まるまでのメッセージの先頭
+	skip  int    // 現在のメッセージの残りのバイト数
+	isIn  bool   // 現在のメッセージが入力か
+	raw   bool   // 解析を諦めた
+}
+
+func newRFBInputWriter(w io.Writer, input, other func(int)) *rfbInputWriter {
+	return &rfbInputWriter{w: w, input: input, other: other}
+}
+
+func (w *rfbInputWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.parse(p[:n])
+	return n, err
+}
+
+func (w *rfbInputWriter) parse(p []byte) {
+	var in, other int
+	add := func(n int, isIn bool) {
+		if isIn {
+			in += n
+		} else {
+			other += n
+		}
+	}
+
+	for len(p) > 0 {
+		if w.raw {
+			in += len(p)
+			break
+		}
+		if w.skip > 0 {
+			k := min(w.skip, len(p))
+			add(k, w.isIn)
+			w.skip -= k
+			p = p[k:]
+			continue
+		}
+
+		w.hdr = append(w.hdr, p[0])
+		p = p[1:]
+		size, isIn, ok := w.messageSize()
+		if !ok {
+			continue
+		}
+		if size < 0 {
+			// 未知のメッセージ以降は区切りが分からない
+			w.raw = true
+			in += len(w.hdr)
+			w.hdr = w.hdr[:0]
+			continue
+		}
+		add(len(w.hdr), isIn)
+		w.skip = size - len(w.hdr)
+		w.isIn = isIn
+		w.hdr = w.hdr[:0]
+	}
+
+	if in > 0 {
+		w.input(in)
+	}
+	if other > 0 {
+		w.other(other)
+	}
+}
+
+// messageSize は hdr から現在のメッセージの長さを求める
+// 長さを決めるのにバイトが足りない場合は ok が false、解析できない場合は size が -1
+// ハンドシェイクの場合はステージを進める
+func (w *rfbInputWriter) messageSize() (size int, isIn, ok bool) {
+	hdr := w.hdr
+	switch w.stage {
+	case rfbStageVersion:
+		if len(hdr) < 12 {
+			return 0, false, false
+		}
+		// 3.3ではサーバがセキュリティタイプを決めるので、クライアントの送信内容だけでは追えない
+		v := string(hdr)
+		if v[:4] != "RFB " || v[11] != '\n' || v == "RFB 003.003\n" {
+			return -1, false, true
+		}
+		w.stage = rfbStageSecurity
+		return 12, false, true
+	case rfbStageSecurity:
+		switch hdr[0] {
+		case 1: // None
+			w.stage = rfbStageClientInit
+		case 2: // VNC認証
+			w.stage = rfbStageVNCAuth
+		default:
+			return -1, false, true
+		}
+		return 1, false, true
+	case rfbStageVNCAuth:
+		w.stage = rfbStageClientInit
+		return 16, false, true
+	case rfbStageClientInit:
+		w.stage = rfbStageMessages
+		return 1, false, true
+	}
+
+	switch hdr[0] {
+	case 0: // SetPixelFormat
+		return 20, false, true
+	case 2: // SetEncodings
+		if len(hdr) < 4 {
+			return 0, false, false
+		}
+		return 4 + 4*int(binary.BigEndian.Uint16(hdr[2:4])), false, true
+	case 3: // FramebufferUpdateRequest
+		return 10, false, true
+	case 4: // KeyEvent
+		return 8, true, true
+	case 5: // PointerEvent
+		return 6, true, true
+	case 6: // ClientCutText (拡張クリップボードでは長さが負)
+		if len(hdr) < 8 {
+			return 0, false, false
+		}
+		n := int32(binary.BigEndian.Uint32(hdr[4:8]))
+		if n < 0 {
+			n = -n
+		}
+		return 8 + int(n), false, true
+	case 150: // EnableContinuousUpdates
+		return 10, false, true
+	case 248: // ClientFence
+		if len(hdr) < 9 {
+			return 0, false, false
+		}
+		return 9 + int(hdr[8]), false, true
+	case 250: // xvp
+		return 4, false, true
+	case 251: // SetDesktopSize
+		if len(hdr) < 8 {
+			return 0, false, false
+		}
+		return 8 + 16*int(hdr[6]), false, true
+	case 255: // QEMUのメッセージ
+		if len(hdr) < 2 {
+			return 0, false, false
+		}
+		switch hdr[1] {
+		case 0: // 拡張キーイベント
+			return 12, true, true
+		case 1: // 音声
+			if len(hdr) < 4 {
+				return 0, false, false
+			}
+			if binary.BigEndian.Uint16(hdr[2:4]) == 2 {
+				return 10, false, true
+			}
+			return 4, false, true
+		}
+	}
+	return -1, false, true
+}
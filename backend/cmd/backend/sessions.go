@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// ログインのセッションはリフレッシュトークンのファミリー単位で管理する
+// IDはファミリーの現在のリフレッシュトークンのIDで、ローテーション済みのトークンのIDでも失効できる
+
+type sessionResponse struct {
+	ID         uint64    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`   // ログインした日時
+	LastUsedAt time.Time `json:"last_used_at"` // 最後にリフレッシュした日時
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"` // このリクエストのセッションか
+}
+
+// sessionTokenID はセッションで開始したコンソールセッションの TokenID を返す
+func sessionTokenID(rt *model.RefreshToken) string {
+	if rt.Family == "" {
+		return rt.Token // ファミリーが導入される前に発行されたトークン
+	}
+	return rt.Family
+}
+
+// userSessions はユーザのログイン中のセッションを新しい順に返す
+func userSessions(c echo.Context, userID uint64) ([]sessionResponse, error) {
+	var tokens []model.RefreshToken
+	err := db.Where("user_id = ? AND rotated_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("id DESC").Find(&tokens).Error
+	if err != nil {
+		return nil, err
+	}
+	current := auth.TokenID(c)
+	res := make([]sessionResponse, len(tokens))
+	for i, rt := range tokens {
+		res[i] = sessionResponse{
+			ID:         rt.ID,
+			UserAgent:  rt.UserAgent,
+			IPAddress:  rt.IPAddress,
+			CreatedAt:  rt.CreatedAt,
+			LastUsedAt: rt.CreatedAt,
+			ExpiresAt:  rt.ExpiresAt,
+			Current:    sessionTokenID(&rt) == current,
+		}
+		if rt.LastUsedAt != nil {
+			res[i].LastUsedAt = *rt.LastUsedAt
+		}
+	}
+	return res, nil
+}
+
+// revokeSession はユーザのセッションを失効し、そのセッションで開始したコンソールセッションを切断する
+func revokeSession(userID, id uint64, reason string) error {
+	var rt model.RefreshToken
+	if err := db.Where("id = ? AND user_id = ?", id, userID).First(&rt).Error; err != nil {
+		if err == gorm.ErrRecordNotFound {
+			return echo.NewHTTPError(http.StatusNotFound, "Session not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	revoke := db.Unscoped().Where("id = ?", rt.ID)
+	if rt.Family != "" {
+		revoke = db.Unscoped().Where("family = ?", rt.Family)
+	}
+	if err := revoke.Delete(&model.RefreshToken{}).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	sessions.CloseByToken(sessionTokenID(&rt), reason)
+	return nil
+}
+
+// revokeSessions はユーザの全てのセッションを失効する
+func revokeSessions(userID uint64, reason string) error {
+	var tokens []model.RefreshToken
+	if err := db.Where("user_id = ?", userID).Find(&tokens).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if err := db.Unscoped().Where("user_id = ?", userID).Delete(&model.RefreshToken{}).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	for i := range tokens {
+		sessions.CloseByToken(sessionTokenID(&tokens[i]), reason)
+	}
+	return nil
+}
+
+// getSessionsHandler は自分のログイン中のセッションの一覧を返す
+func getSessionsHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	res, err := userSessions(c, user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// deleteSessionHandler は自分のセッションをログアウトさせる
+func deleteSessionHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := revokeSession(user.ID, parseUintParam(c, "id"), "session revoked"); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session revoked successfully"})
+}
+
+// deleteSessionsHandler は自分の全てのセッション (このリクエストのセッションを含む) をログアウトさせる
+func deleteSessionsHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := revokeSessions(user.ID, "logged out everywhere"); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Logged out everywhere successfully"})
+}
+
+// sessionTarget はセッションを管理する組織のメンバーを返す
+// ログインのセッションは組織をまたいで共通なので、ユーザが所属する全ての組織の管理者でなければ管理できない
+func sessionTarget(c echo.Context) (*model.User, error) {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return nil, err
+	}
+	target, err := orgMember(user.OrganizationID, parseUintParam(c, "id"))
+	if err != nil {
+		return nil, err
+	}
+
+	var orgIDs []uint64
+	if err := db.Model(&model.User{}).Where("id = ?", target.ID).Pluck("organization_id", &orgIDs).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	var memberOf []uint64
+	if err := db.Model(&model.Membership{}).Where("user_id = ?", target.ID).Pluck("organization_id", &memberOf).Error; err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	for _, orgID := range append(orgIDs, memberOf...) {
+		member, err := asMember(user, orgID)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+		}
+		if member == nil || checkPermission(member, model.PermissionManage) != nil {
+			return nil, echo.NewHTTPError(http.StatusForbidden, "Permission denied: the user belongs to an organization you do not manage")
+		}
+	}
+	return target, nil
+}
+
+// getUserSessionsHandler は組織のユーザのログイン中のセッションの一覧を返す
+func getUserSessionsHandler(c echo.Context) error {
+	target, err := sessionTarget(c)
+	if err != nil {
+		return err
+	}
+	res, err := userSessions(c, target.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// deleteUserSessionHandler は組織のユーザのセッションをログアウトさせる
+func deleteUserSessionHandler(c echo.Context) error {
+	target, err := sessionTarget(c)
+	if err != nil {
+		return err
+	}
+	if err := revokeSession(target.ID, parseUintParam(c, "session_id"), "session revoked by administrator"); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Session revoked successfully"})
+}
+
+// deleteUserSessionsHandler は組織のユーザの全てのセッションをログアウトさせる
+func deleteUserSessionsHandler(c echo.Context) error {
+	target, err := sessionTarget(c)
+	if err != nil {
+		return err
+	}
+	if err := revokeSessions(target.ID, "logged out by administrator"); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Logged out everywhere successfully"})
+}
+
+// cleanupRefreshTokens は期限切れのリフレッシュトークンを定期的に削除する
+func cleanupRefreshTokens(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if n, err := auth.PurgeExpiredRefreshTokens(db); err != nil {
+			log.Println("期限切れのリフレッシュトークンの削除に失敗:", err)
+		} else if n > 0 {
+			log.Printf("期限切れのリフレッシュトークンを %d 件削除", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/model"
+)
+
+// apiKeyMiddleware は Authorization: ApiKey <access>:<secret> のリクエストを認証する
+// それ以外のリクエストはJWTの検証に任せる
+func apiKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !auth.IsAPIKeyRequest(c) {
+			return next(c)
+		}
+		if _, err := auth.APIKeyAuth(c, db); err != nil {
+			if errors.Is(err, auth.ErrInvalidAPIKey) {
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid API key")
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+		}
+		return next(c)
+	}
+}
+
+// requireScope はAPIキーでのリクエストにスコープを要求する
+// JWTでのリクエストは制限しない
+func requireScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token := auth.APITokenFromContext(c); token != nil && !auth.HasScope(token, scope) {
+				return echo.NewHTTPError(http.StatusForbidden, "API token does not have the "+scope+" scope")
+			}
+			return next(c)
+		}
+	}
+}
+
+// requireSession はAPIキーでのリクエストを拒否する
+// トークン自体の管理はログインしたユーザのみ行える
+func requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if auth.APITokenFromContext(c) != nil {
+			return echo.NewHTTPError(http.StatusForbidden, "API tokens cannot be used for this operation")
+		}
+		return next(c)
+	}
+}
+
+type apiTokenResponse struct {
+	model.APIToken
+	Scopes []string `json:"scopes"`
+}
+
+func newAPITokenResponse(t *model.APIToken) apiTokenResponse {
+	return apiTokenResponse{APIToken: *t, Scopes: auth.TokenScopes(t)}
+}
+
+type createAPITokenRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`     // 省略した場合は全てのスコープ
+	ExpiresAt *time.Time `json:"expires_at"` // 省略した場合は無期限
+}
+
+// getAPITokensHandler は自分のAPIトークンの一覧を返す
+func getAPITokensHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+
+	var tokens []model.APIToken
+	if err := db.Where("user_id = ?", user.ID).Order("id").Find(&tokens).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	res := make([]apiTokenResponse, len(tokens))
+	for i := range tokens {
+		res[i] = newAPITokenResponse(&tokens[i])
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// createAPITokenHandler はAPIトークンを作成する
+// シークレットはこのレスポンスでのみ返す
+func createAPITokenHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+
+	var req createAPITokenRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request format")
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 64 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Name is required and must be at most 64 characters")
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Expiry must be in the future")
+	}
+
+	token, secret, err := auth.CreateAPIToken(db, user.ID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, auth.ErrUnknownScope) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to create API token")
+	}
+
+	return c.JSON(http.StatusCreated, map[string]any{
+		"token":  newAPITokenResponse(token),
+		"secret": token.AccessToken + ":" + secret, // Authorization: ApiKey <secret> で使う
+	})
+}
+
+// deleteAPITokenHandler はAPIトークンを失効させる
+// トークンで開始したコンソールセッションも切断する
+func deleteAPITokenHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+
+	id := parseUintParam(c, "id")
+	res := db.Where("id = ? AND user_id = ?", id, user.ID).Delete(&model.APIToken{})
+	if res.Error != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if res.RowsAffected == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "API token not found")
+	}
+	sessions.CloseByToken(auth.APITokenSessionID(id), "API token revoked")
+	return c.JSON(http.StatusOK, map[string]string{"message": "API token revoked successfully"})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/auth"
+	"github.com/masa23/webapp-test/model"
+)
+
+func loginTwoFactorHandler(c echo.Context) error {
+	return auth.LoginTwoFactor(c, db, challenges, conf.RefreshToken.Duration)
+}
+
+func loginEnrollTOTPHandler(c echo.Context) error {
+	return auth.LoginEnrollTOTP(c, db, challenges, conf.TwoFactor.Issuer)
+}
+
+type twoFactorCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// twoFactorError は二段階認証のエラーをHTTPエラーに変換する
+func twoFactorError(err error) error {
+	switch {
+	case errors.Is(err, auth.ErrInvalidTwoFactorCode):
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid two-factor code")
+	case errors.Is(err, auth.ErrTOTPAlreadyEnabled):
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is already enabled")
+	case errors.Is(err, auth.ErrTOTPNotEnrolled):
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is not enrolled")
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+}
+
+// enrollTOTPHandler は認証アプリに登録するシークレットを生成する
+func enrollTOTPHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	secret, uri, err := auth.EnrollTOTP(db, user, conf.TwoFactor.Issuer)
+	if err != nil {
+		return twoFactorError(err)
+	}
+	return c.JSON(http.StatusOK, auth.TOTPEnrollmentResponse{Secret: secret, URI: uri})
+}
+
+// verifyTOTPHandler は認証アプリのコードを確認して二段階認証を有効にし、リカバリーコードを返す
+func verifyTOTPHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	var req twoFactorCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	codes, err := auth.EnableTOTP(db, user, req.Code)
+	if err != nil {
+		return twoFactorError(err)
+	}
+	return c.JSON(http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// regenerateRecoveryCodesHandler はコードを確認してリカバリーコードを作り直す
+func regenerateRecoveryCodesHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	var req twoFactorCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	if err := auth.VerifyTwoFactor(db, user, req.Code, req.RecoveryCode); err != nil {
+		return twoFactorError(err)
+	}
+	codes, err := auth.ReplaceRecoveryCodes(db, user.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return c.JSON(http.StatusOK, recoveryCodesResponse{RecoveryCodes: codes})
+}
+
+// disableTOTPHandler はコードを確認して二段階認証を無効にする
+// 所属する組織で必須の場合は無効にできない
+func disableTOTPHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	var req twoFactorCodeRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+	required, err := auth.TwoFactorRequired(db, user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	if required {
+		return echo.NewHTTPError(http.StatusConflict, "Two-factor authentication is required by the organization")
+	}
+	if err := auth.VerifyTwoFactor(db, user, req.Code, req.RecoveryCode); err != nil {
+		return twoFactorError(err)
+	}
+	if err := auth.DisableTOTP(db, user); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+type updateTwoFactorPolicyRequest struct {
+	Required bool `json:"required"`
+}
+
+// updateTwoFactorPolicyHandler は組織のメンバーに二段階認証を必須にするかを変更する
+// 必須にした後は、未登録のメンバーは次回のログイン時に登録を求められる
+func updateTwoFactorPolicyHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+	var req updateTwoFactorPolicyRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	var org model.Organization
+	if err := db.First(&org, user.OrganizationID).Error; err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, "Organization not found")
+	}
+	if err := db.Model(&org).Update("require_two_factor", req.Required).Error; err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return c.JSON(http.StatusOK, org)
+}
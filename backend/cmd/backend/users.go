@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/masa23/webapp-test/console"
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// getUsersHandler は組織のユーザの一覧を返す
+func getUsersHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	users, err := orgMembers(user.OrganizationID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	return c.JSON(http.StatusOK, users)
+}
+
+type updateUserRoleRequest struct {
+	Role model.Role `json:"role"`
+}
+
+// updateUserRoleHandler は組織のユーザの役割を変更する
+// 組織の最後の admin は変更できない
+func updateUserRoleHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	var req updateUserRoleRequest
+	if err := c.Bind(&req); err != nil || !req.Role.Valid() {
+		return echo.NewHTTPError(http.StatusBadRequest, "Role must be viewer, operator or admin")
+	}
+
+	target, err := orgMember(user.OrganizationID, parseUintParam(c, "id"))
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if target.Role == model.RoleAdmin && req.Role != model.RoleAdmin {
+			if err := checkLastAdmin(tx, target); err != nil {
+				return err
+			}
+		}
+		return updateMember(tx, target, "role", req.Role)
+	})
+	if err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	target.Role = req.Role
+	// コンソールの権限を失ったユーザの接続を切断する
+	revalidateConsoleSessions(func(s *console.Session) bool { return s.UserID == target.ID }, "role changed")
+	return c.JSON(http.StatusOK, target)
+}
+
+// checkLastAdmin は対象のユーザが組織で最後の制限されていない admin であればエラーを返す
+func checkLastAdmin(tx *gorm.DB, target *model.User) error {
+	if target.Role != model.RoleAdmin || target.Restricted {
+		return nil
+	}
+	// 既定の組織のユーザと他の組織から所属するユーザの両方を数える
+	var admins, memberAdmins int64
+	if err := tx.Model(&model.User{}).Where("organization_id = ? AND role = ? AND restricted = ?", target.OrganizationID, model.RoleAdmin, false).Count(&admins).Error; err != nil {
+		return err
+	}
+	if err := tx.Model(&model.Membership{}).Where("organization_id = ? AND role = ? AND restricted = ?", target.OrganizationID, model.RoleAdmin, false).Count(&memberAdmins).Error; err != nil {
+		return err
+	}
+	if admins+memberAdmins <= 1 {
+		return echo.NewHTTPError(http.StatusConflict, "Cannot change the role of the last admin")
+	}
+	return nil
+}
+
+type updateUserRestrictedRequest struct {
+	Restricted bool `json:"restricted"`
+}
+
+// updateUserRestrictedHandler はユーザを制限付きにするかを変更する
+// 制限付きユーザはサーバ単位で権限を付与されたサーバのみ操作できる
+func updateUserRestrictedHandler(c echo.Context) error {
+	user, err := authenticatedUser(c)
+	if err != nil {
+		return err
+	}
+	if err := checkPermission(user, model.PermissionManage); err != nil {
+		return err
+	}
+
+	var req updateUserRestrictedRequest
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request")
+	}
+
+	target, err := orgMember(user.OrganizationID, parseUintParam(c, "id"))
+	if err != nil {
+		return err
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if req.Restricted {
+			if err := checkLastAdmin(tx, target); err != nil {
+				return err
+			}
+		}
+		return updateMember(tx, target, "restricted", req.Restricted)
+	})
+	if err != nil {
+		if he, ok := err.(*echo.HTTPError); ok {
+			return he
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "Database error")
+	}
+	target.Restricted = req.Restricted
+	revalidateConsoleSessions(func(s *console.Session) bool { return s.UserID == target.ID }, "access restricted")
+	return c.JSON(http.StatusOK, target)
+}
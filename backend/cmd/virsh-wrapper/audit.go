@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"os"
+	"strings"
+	"time"
+)
+
+// auditRecord は1回の実行の監査ログ
+type auditRecord struct {
+	Time            time.Time `json:"time"`
+	OriginalCommand string    `json:"original_command"` // SSH_ORIGINAL_COMMAND
+	Profile         string    `json:"profile"`
+	Command         string    `json:"command"`
+	Domain          string    `json:"domain"`
+	ClientIP        string    `json:"client_ip"` // SSH_CLIENT の送信元アドレス
+	Allowed         bool      `json:"allowed"`   // ポリシーで許可されたか
+	ExitStatus      int       `json:"exit_status"`
+	DurationMS      int64     `json:"duration_ms"`
+}
+
+func newAuditRecord(profile string) *auditRecord {
+	r := &auditRecord{
+		Time:            time.Now(),
+		OriginalCommand: os.Getenv("SSH_ORIGINAL_COMMAND"),
+		Profile:         profile,
+	}
+	// SSH_CLIENT は "<client ip> <client port> <server port>"
+	if f := strings.Fields(os.Getenv("SSH_CLIENT")); len(f) > 0 {
+		r.ClientIP = f[0]
+	}
+	return r
+}
+
+// writeAuditLog は監査ログを出力する
+// dest が "syslog" の場合はsyslog(journald)に、"none" の場合は出力せず、
+// それ以外はファイルパスとしてJSON Linesで追記する
+func writeAuditLog(dest string, r *auditRecord) error {
+	r.DurationMS = time.Since(r.Time).Milliseconds()
+
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	switch dest {
+	case "none", "":
+		return nil
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_INFO, "virsh-wrapper")
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+		if !r.Allowed {
+			return w.Warning(string(buf))
+		}
+		return w.Info(string(buf))
+	default:
+		f, err := os.OpenFile(dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = f.Write(append(buf, '\n'))
+		return err
+	}
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/caarlos0/go-shellwords"
+	"github.com/masa23/webapp-test/libvirt"
 )
 
 // このプログラムは、SSH経由で特定の virsh コマンドのみを実行できるようにするラッパーです。
@@ -13,9 +20,14 @@ import (
 // virshの実行が出来る必要があるため、libvirtグループに所属していることが前提です。
 // このラッパーは、SSH_ORIGINAL_COMMAND 環境変数を使用してコマンドを受け取り、
 // 許可されたコマンドのみを実行します。
+// 先頭に --json を付けると、実行結果を libvirt.Result のJSONで出力します。
+// screenshot は画像をそのまま標準出力に書き出します (--json の場合は Result.Data に入れます)。
+// 実行できるコマンドとドメインはポリシーファイル (/etc/virsh-wrapper.yaml) で
+// プロファイルごとに制限でき、プロファイルは authorized_keys の
+// command="/home/vmmgr/.local/bin/virsh-wrapper --profile tenant1" で鍵ごとに指定します。
 
 // allowCommands は許可されている virsh コマンドのリスト
-// これらのコマンドのみが実行可能
+// ポリシーファイルで許可してもこれ以外のコマンドは実行できない
 var allowCommands = []string{
 	"start",
 	"shutdown",
@@ -24,6 +36,13 @@ var allowCommands = []string{
 	"destroy",
 	"dominfo",
 	"domdisplay",
+	"screenshot",
+}
+
+// interactiveCommands は端末を接続して実行するコマンドのリスト
+// ポリシーファイルのプロファイルで明示的に許可した場合のみ実行可能
+var interactiveCommands = []string{
+	"console",
 }
 
 // PATHの環境変数で脆弱性を避けるためにフルパス
@@ -35,37 +54,277 @@ func isAllowedCommand(command string) bool {
 			return true
 		}
 	}
+	return isInteractiveCommand(command)
+}
+
+func isInteractiveCommand(command string) bool {
+	for _, allowed := range interactiveCommands {
+		if command == allowed {
+			return true
+		}
+	}
 	return false
 }
 
+// parseOutput はコマンドごとに virsh の出力を解析する
+// 解析対象でないコマンドは nil を返す
+func parseOutput(command, stdout string) (any, error) {
+	switch command {
+	case "dominfo":
+		return libvirt.ParseDomInfo(stdout)
+	case "domdisplay":
+		return libvirt.ParseDomDisplay(stdout)
+	}
+	return nil, nil
+}
+
+// runJSON はコマンドを実行し、標準出力に書き出す結果を返す
+func runJSON(cmd *exec.Cmd, command, domain string) *libvirt.Result {
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	result := libvirt.Result{
+		Version: libvirt.ResultVersion,
+		Command: command,
+		Domain:  domain,
+	}
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.ExitCode()
+		} else {
+			result.ExitCode = 1
+			stderr.WriteString(err.Error())
+		}
+	}
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	if result.ExitCode == 0 {
+		parsed, err := parseOutput(command, result.Stdout)
+		if err != nil {
+			result.Stderr += "failed to parse output: " + err.Error()
+		} else if parsed != nil {
+			buf, err := json.Marshal(parsed)
+			if err != nil {
+				result.Stderr += "failed to encode output: " + err.Error()
+			} else {
+				result.Parsed = buf
+			}
+		}
+	}
+
+	return &result
+}
+
+// runScreenshot はドメインの画面を一時ファイルに保存し、その内容を標準出力に書き出す
+// virsh screenshot は標準出力に書き出せないため一時ファイルを経由する
+// --json の場合は書き出さずに結果を返す
+func runScreenshot(jsonMode bool, domain string) (int, *libvirt.Result) {
+	result := libvirt.Result{
+		Version: libvirt.ResultVersion,
+		Command: "screenshot",
+		Domain:  domain,
+	}
+	dir, err := os.MkdirTemp("", "virsh-wrapper-")
+	if err != nil {
+		if jsonMode {
+			result.ExitCode = 1
+			result.Stderr = "failed to create temporary directory: " + err.Error()
+			return result.ExitCode, &result
+		}
+		fmt.Fprintf(os.Stderr, "Error creating temporary directory: %v\n", err)
+		return 1, nil
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "screen")
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(virshCommand[0], append(virshCommand[1:], "screenshot", domain, "--file", file)...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+	// 標準出力は "Screenshot saved to ..." のメッセージなので捨てる
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			result.ExitCode = exitErr.ExitCode()
+		} else {
+			result.ExitCode = 1
+			stderr.WriteString(err.Error())
+		}
+	}
+	if result.ExitCode == 0 {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			result.ExitCode = 1
+			stderr.WriteString("failed to read screenshot: " + err.Error())
+		}
+		result.Data = data
+	}
+	result.Stderr = stderr.String()
+
+	if jsonMode {
+		return result.ExitCode, &result
+	}
+
+	os.Stderr.WriteString(result.Stderr)
+	if result.ExitCode == 0 {
+		if _, err := os.Stdout.Write(result.Data); err != nil {
+			return 1, nil
+		}
+	}
+	return result.ExitCode, nil
+}
+
+// runInteractive は端末を接続したままコマンドを実行する
+// virsh console は制御端末が必要なため、SSH接続時にptyを要求する必要がある
+func runInteractive(command, domain string) int {
+	args := append([]string{}, virshCommand[1:]...)
+	args = append(args, command)
+	if command == "console" {
+		// 他のセッションが接続していても奪う
+		args = append(args, "--force")
+	}
+	args = append(args, domain)
+	cmd := exec.Command(virshCommand[0], args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode()
+		}
+		fmt.Printf("Error executing command: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// deny はポリシーにより拒否されたことを出力して終了コードを返す
+// --json の場合は出力せずに結果を返す
+func deny(jsonMode bool, command, domain, message string) (int, *libvirt.Result) {
+	if jsonMode {
+		return libvirt.ExitDenied, &libvirt.Result{
+			Version:  libvirt.ResultVersion,
+			Command:  command,
+			Domain:   domain,
+			ExitCode: libvirt.ExitDenied,
+			Stderr:   message,
+		}
+	}
+	fmt.Println(message)
+	return libvirt.ExitDenied, nil
+}
+
 func main() {
+	// authorized_keys の command= で指定されたオプション
+	// SSH_ORIGINAL_COMMAND からは指定できない
+	profileName := flag.String("profile", "", "Policy profile name")
+	policyPath := flag.String("policy", defaultPolicyPath, "Path to policy file")
+	auditLog := flag.String("audit-log", "syslog", "Audit log destination (syslog, none or path to JSON lines file)")
+	flag.Parse()
+
+	audit := newAuditRecord(*profileName)
+	code, result := run(audit, *policyPath, *profileName)
+	os.Exit(finish(os.Stdout, *auditLog, audit, code, result))
+}
+
+// finish は監査ログを出力し、--json の場合は結果を w に書き出して終了コードを返す
+// --json の場合はJSON以外を出力しないように、監査ログの出力の失敗は結果の Stderr に含める
+func finish(w io.Writer, auditLog string, audit *auditRecord, code int, result *libvirt.Result) int {
+	audit.ExitStatus = code
+	if err := writeAuditLog(auditLog, audit); err != nil {
+		if result == nil {
+			fmt.Fprintf(os.Stderr, "Error writing audit log: %v\n", err)
+		} else {
+			if result.Stderr != "" && !strings.HasSuffix(result.Stderr, "\n") {
+				result.Stderr += "\n"
+			}
+			result.Stderr += "failed to write audit log: " + err.Error()
+		}
+	}
+
+	if result != nil {
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "Error encoding result: %v\n", err)
+			return 1
+		}
+	}
+	return code
+}
+
+// run はコマンドを解析して実行し、終了コードを返す
+// --json の場合は標準出力に書き出す結果も返す
+// 監査ログに必要な情報は audit に設定する
+func run(audit *auditRecord, policyPath, profileName string) (int, *libvirt.Result) {
+	args := append([]string{os.Args[0]}, flag.Args()...)
+
 	// SSH_ORIGINAL_COMMAND が設定されている場合は、それをコマンドとして使用
 	if sshCommand := os.Getenv("SSH_ORIGINAL_COMMAND"); sshCommand != "" {
 		parser := shellwords.NewParser()
-		args, err := parser.Parse(sshCommand)
+		parsed, err := parser.Parse(sshCommand)
 		if err != nil {
 			fmt.Printf("Error parsing SSH_ORIGINAL_COMMAND: %v\n", err)
-			os.Exit(1)
+			return 1, nil
 		}
-		os.Args = args
+		args = parsed
+	}
+
+	// --json が指定されている場合はJSONで結果を返す
+	jsonMode := false
+	if len(args) > 1 && args[1] == "--json" {
+		jsonMode = true
+		args = append(args[:1], args[2:]...)
 	}
+
 	// コマンドライン引数を取得
-	if len(os.Args) != 3 {
-		fmt.Println("Usage: virsh-wrapper <command> <domain>")
-		os.Exit(1)
+	if len(args) != 3 {
+		fmt.Println("Usage: virsh-wrapper [--json] <command> <domain>")
+		return 1, nil
+	}
+
+	command := args[1]
+	domain := args[2]
+	audit.Command = command
+	audit.Domain = domain
+
+	// ポリシーでコマンドとドメインが許可されているかチェック
+	policy, err := loadPolicy(policyPath)
+	if err != nil {
+		fmt.Printf("Error loading policy: %v\n", err)
+		return 1, nil
+	}
+	profile, err := resolveProfile(policy, profileName)
+	if err != nil {
+		return deny(jsonMode, command, domain, err.Error())
 	}
+	if err := profile.Allow(command, domain); err != nil {
+		return deny(jsonMode, command, domain, err.Error())
+	}
+	audit.Allowed = true
 
-	command := os.Args[1]
-	domain := os.Args[2]
+	if isInteractiveCommand(command) {
+		if jsonMode {
+			fmt.Printf("Command '%s' does not support --json\n", command)
+			return 1, nil
+		}
+		return runInteractive(command, domain), nil
+	}
 
-	// コマンドが許可されているかチェック
-	if !isAllowedCommand(command) {
-		fmt.Printf("Command '%s' is not allowed\n", command)
-		os.Exit(1)
+	if command == "screenshot" {
+		return runScreenshot(jsonMode, domain)
 	}
 
 	// 実行するコマンドを組み立てる
 	cmd := exec.Command(virshCommand[0], append(virshCommand[1:], command, domain)...)
+	// 出力を解析するためロケールを固定する
+	cmd.Env = append(os.Environ(), "LC_ALL=C")
+
+	if jsonMode {
+		result := runJSON(cmd, command, domain)
+		return result.ExitCode, result
+	}
 
 	// 標準出力と標準エラーを取得
 	cmd.Stdout = os.Stdout
@@ -76,9 +335,10 @@ func main() {
 		fmt.Printf("Error executing command: %v\n", err)
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			// コマンドが非ゼロの終了コードで終了した場合、そのコードを返す
-			os.Exit(exitErr.ExitCode())
+			return exitErr.ExitCode(), nil
 		}
 		// その他のエラーは1で終了
-		os.Exit(1)
+		return 1, nil
 	}
+	return 0, nil
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/masa23/webapp-test/libvirt"
+)
+
+func TestAuditLogFailureJSON(t *testing.T) {
+	// virsh の代わりに dominfo の出力と警告を書き出す
+	saved := virshCommand
+	virshCommand = []string{"sh", "-c", `printf 'Name: vm1\nState: running\n'; echo warning >&2`}
+	defer func() { virshCommand = saved }()
+	t.Setenv("SSH_ORIGINAL_COMMAND", "virsh-wrapper --json dominfo vm1")
+
+	dir := t.TempDir()
+	audit := newAuditRecord("")
+	code, result := run(audit, filepath.Join(dir, "virsh-wrapper.yaml"), "")
+
+	// 書き込めない監査ログの出力先
+	var stdout bytes.Buffer
+	if code := finish(&stdout, filepath.Join(dir, "missing", "audit.log"), audit, code, result); code != 0 {
+		t.Fatalf("exit code = %d", code)
+	}
+
+	// バックエンドは標準出力の結果を解析できる
+	res, err := libvirt.ParseResult(stdout.Bytes())
+	if err != nil {
+		t.Fatalf("ParseResult: %v (%q)", err, stdout.String())
+	}
+	var info libvirt.DomInfo
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := res.Decode(&info); err != nil || info.State != "running" {
+		t.Errorf("dominfo = %+v, %v", info, err)
+	}
+	if !strings.Contains(res.Stderr, "warning\nfailed to write audit log: ") {
+		t.Errorf("stderr = %q", res.Stderr)
+	}
+}
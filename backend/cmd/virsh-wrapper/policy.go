@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultPolicyPath はポリシーファイルの既定のパス
+const defaultPolicyPath = "/etc/virsh-wrapper.yaml"
+
+// defaultProfile は --profile が指定されなかった場合に使うプロファイル名
+const defaultProfile = "default"
+
+// Policy はポリシーファイルの内容
+//
+//	Profiles:
+//	  default:
+//	    Commands: [dominfo, domdisplay]
+//	    Domains: ["*"]
+//	  tenant1:
+//	    Commands: [start, shutdown, reboot, reset, destroy, dominfo, domdisplay, console]
+//	    Domains: ["tenant1-*"]
+//	    DomainRegexps: ["web[0-9]+"]
+type Policy struct {
+	Profiles map[string]*Profile `yaml:"Profiles"`
+}
+
+// Profile はSSH鍵ごとに許可するコマンドとドメイン
+type Profile struct {
+	Commands      []string `yaml:"Commands"`      // 許可するコマンド (allowCommands, interactiveCommands に含まれるもののみ有効)
+	Domains       []string `yaml:"Domains"`       // 許可するドメイン名のglob
+	DomainRegexps []string `yaml:"DomainRegexps"` // 許可するドメイン名の正規表現 (全体一致)
+
+	regexps []*regexp.Regexp
+}
+
+// loadPolicy はポリシーファイルを読み込む
+// ファイルが存在しない場合は nil を返す
+func loadPolicy(p string) (*Policy, error) {
+	buf, err := os.ReadFile(p)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var policy Policy
+	if err := yaml.Unmarshal(buf, &policy); err != nil {
+		return nil, err
+	}
+
+	for name, profile := range policy.Profiles {
+		if profile == nil {
+			return nil, fmt.Errorf("profile %q is empty", name)
+		}
+		for _, g := range profile.Domains {
+			if _, err := path.Match(g, ""); err != nil {
+				return nil, fmt.Errorf("profile %q: invalid domain glob %q: %w", name, g, err)
+			}
+		}
+		for _, r := range profile.DomainRegexps {
+			re, err := regexp.Compile("^(?:" + r + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: invalid domain regexp %q: %w", name, r, err)
+			}
+			profile.regexps = append(profile.regexps, re)
+		}
+	}
+	return &policy, nil
+}
+
+// builtinProfile はポリシーファイルがない場合に使うプロファイル
+// 全てのドメインに allowCommands の実行を許可する
+// interactiveCommands は含まない
+func builtinProfile() *Profile {
+	return &Profile{Commands: allowCommands, Domains: []string{"*"}}
+}
+
+// Allow は command を domain に対して実行できるかを返す
+func (p *Profile) Allow(command, domain string) error {
+	if !isAllowedCommand(command) || !contains(p.Commands, command) {
+		return fmt.Errorf("command '%s' is not allowed", command)
+	}
+	for _, g := range p.Domains {
+		if ok, _ := path.Match(g, domain); ok {
+			return nil
+		}
+	}
+	for _, re := range p.regexps {
+		if re.MatchString(domain) {
+			return nil
+		}
+	}
+	return fmt.Errorf("domain '%s' is not allowed", domain)
+}
+
+// resolveProfile はプロファイル名に対応するプロファイルを返す
+func resolveProfile(policy *Policy, name string) (*Profile, error) {
+	if policy == nil {
+		// ポリシーファイルがない場合はプロファイル指定なしのみ従来通り動作させる
+		if name != "" {
+			return nil, fmt.Errorf("profile '%s' is not defined", name)
+		}
+		return builtinProfile(), nil
+	}
+	if name == "" {
+		name = defaultProfile
+	}
+	profile, ok := policy.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("profile '%s' is not defined", name)
+	}
+	return profile, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
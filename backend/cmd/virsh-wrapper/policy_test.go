@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "virsh-wrapper.yaml")
+	if err := os.WriteFile(path, []byte(`
+Profiles:
+  default:
+    Commands: [dominfo]
+    Domains: ["*"]
+  tenant1:
+    Commands: [start, destroy, dominfo, domdisplay, undefine]
+    Domains: ["tenant1-*"]
+    DomainRegexps: ["web[0-9]+"]
+`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err := loadPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		profile string
+		command string
+		domain  string
+		allowed bool
+	}{
+		{"", "dominfo", "host-vm", true},
+		{"", "destroy", "host-vm", false},
+		{"tenant1", "destroy", "tenant1-db", true},
+		{"tenant1", "destroy", "tenant2-db", false},
+		{"tenant1", "start", "web01", true},
+		{"tenant1", "start", "xweb01", false},
+		// allowCommands にないコマンドはポリシーで許可しても実行できない
+		{"tenant1", "undefine", "tenant1-db", false},
+		{"unknown", "dominfo", "tenant1-db", false},
+	}
+	for _, tt := range tests {
+		profile, err := resolveProfile(policy, tt.profile)
+		if err == nil {
+			err = profile.Allow(tt.command, tt.domain)
+		}
+		if (err == nil) != tt.allowed {
+			t.Errorf("profile=%q command=%q domain=%q: allowed=%v, want %v (%v)", tt.profile, tt.command, tt.domain, err == nil, tt.allowed, err)
+		}
+	}
+}
+
+func TestPolicyNotExist(t *testing.T) {
+	policy, err := loadPolicy(filepath.Join(t.TempDir(), "not-exist.yaml"))
+	if err != nil || policy != nil {
+		t.Fatalf("loadPolicy = %v, %v", policy, err)
+	}
+
+	// ポリシーファイルがなければ従来通り全ドメインに許可
+	profile, err := resolveProfile(policy, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := profile.Allow("destroy", "any"); err != nil {
+		t.Error(err)
+	}
+	// コンソールは明示的に許可しない限り使えない
+	if err := profile.Allow("console", "any"); err == nil {
+		t.Error("console is allowed without policy file")
+	}
+
+	// プロファイル指定があれば拒否
+	if _, err := resolveProfile(policy, "tenant1"); err == nil {
+		t.Error("resolveProfile succeeded without policy file")
+	}
+}
@@ -2,7 +2,10 @@ package config
 
 import (
 	"errors"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -14,8 +17,120 @@ type Config struct {
 		Duration  time.Duration `yaml:"Duration"`
 	} `yaml:"AccessToken"`
 	RefreshToken struct {
-		Duration time.Duration `yaml:"Duration"`
+		Duration        time.Duration `yaml:"Duration"`
+		CleanupInterval time.Duration `yaml:"CleanupInterval"` // 期限切れのトークンを削除する間隔
 	} `yaml:"RefreshToken"`
+	// CORSとWebSocketで許可するフロントエンドのオリジン
+	// 同一オリジンからのリクエストは設定に関わらず許可する
+	// Viteの開発サーバのプロキシ経由ではHostが書き換えられるため http://localhost:5173 を指定すること
+	CORS struct {
+		AllowOrigins     []string `yaml:"AllowOrigins"`     // 許可するオリジン (例: https://vmmgr.example.com)、"*" で全て許可
+		AllowCredentials bool     `yaml:"AllowCredentials"` // クッキー(リフレッシュトークン)の送信を許可するか
+	} `yaml:"CORS"`
+	Hypervisor struct {
+		Executor string `yaml:"Executor"` // ssh または local
+		User     string `yaml:"User"`     // SSH接続ユーザ
+		SSH      struct {
+			// 空の場合は ssh コマンドと同じく ~/.ssh/id_ed25519, ~/.ssh/id_ecdsa, ~/.ssh/id_rsa の順に探す
+			PrivateKey string `yaml:"PrivateKey"` // 秘密鍵のパス
+			// 空の場合は ~/.ssh/known_hosts があれば使う
+			KnownHosts string `yaml:"KnownHosts"` // known_hostsファイルのパス
+			Port       int    `yaml:"Port"`
+		} `yaml:"SSH"`
+		Timeout struct {
+			Status     time.Duration `yaml:"Status"`     // 状態取得
+			Power      time.Duration `yaml:"Power"`      // 電源操作
+			Display    time.Duration `yaml:"Display"`    // VNCポート取得
+			Screenshot time.Duration `yaml:"Screenshot"` // スクリーンショット取得
+		} `yaml:"Timeout"`
+		Concurrency    int           `yaml:"Concurrency"`    // 状態取得を並行して行うホスト数
+		StatusCacheTTL time.Duration `yaml:"StatusCacheTTL"` // 一覧用の状態キャッシュの有効期間
+		// ScreenshotCacheTTL はサーバごとのスクリーンショットのキャッシュの有効期間
+		ScreenshotCacheTTL time.Duration `yaml:"ScreenshotCacheTTL"`
+		// ReconcileInterval を設定すると状態をバックグラウンドで取得してDBに保存し、
+		// APIはDBの値を返すようになる (0 の場合は無効)
+		ReconcileInterval time.Duration `yaml:"ReconcileInterval"`
+		// VNCへの接続方法
+		// direct: バックエンドからハイパーバイザのVNCポートに直接接続する
+		// ssh: SSHのdirect-tcpipでハイパーバイザのlocalhostのVNCポートに接続する
+		VNC struct {
+			Mode  string            `yaml:"Mode"`  // 既定の接続方法
+			Hosts map[string]string `yaml:"Hosts"` // ホスト名ごとの接続方法
+		} `yaml:"VNC"`
+	} `yaml:"Hypervisor"`
+	Console struct {
+		TicketDuration time.Duration `yaml:"TicketDuration"` // 接続用チケットの有効期間
+		RecordingDir   string        `yaml:"RecordingDir"`   // VNCコンソールの録画の保存先
+		IdleTimeout    time.Duration `yaml:"IdleTimeout"`    // クライアントからの入力がない場合に切断するまでの時間 (0で無効)
+		MaxDuration    time.Duration `yaml:"MaxDuration"`    // 1回の接続の最大時間 (0で無制限)
+		PingInterval   time.Duration `yaml:"PingInterval"`   // WebSocketのpingを送信する間隔
+	} `yaml:"Console"`
+	TwoFactor struct {
+		Issuer            string        `yaml:"Issuer"`            // 認証アプリに表示される発行者名
+		ChallengeDuration time.Duration `yaml:"ChallengeDuration"` // パスワード認証後にコードを入力できる時間
+	} `yaml:"TwoFactor"`
+	// OpenID Connectによるシングルサインオン (Issuer を設定すると有効)
+	OIDC struct {
+		Issuer        string   `yaml:"Issuer"`        // IdPのIssuer URL
+		ClientID      string   `yaml:"ClientID"`      // クライアントID
+		ClientSecret  string   `yaml:"ClientSecret"`  // クライアントシークレット (公開クライアントの場合は空)
+		RedirectURL   string   `yaml:"RedirectURL"`   // /auth/oidc/callback の外部から見たURL
+		Scopes        []string `yaml:"Scopes"`        // openid 以外に要求するスコープ
+		UsernameClaim string   `yaml:"UsernameClaim"` // ユーザ名として使うクレーム
+		GroupsClaim   string   `yaml:"GroupsClaim"`   // グループの一覧のクレーム
+		AutoProvision bool     `yaml:"AutoProvision"` // 存在しないユーザを自動で作成するか
+		// LinkExistingUsers はIdPのユーザ名と一致する既存のユーザに紐付けるか
+		// IdPでユーザ名を変更できる場合は乗っ取りに使えるため、ユーザ名を管理者のみが設定できる場合に有効にする
+		// パスワードを持つユーザとLDAPのユーザには紐付けない
+		LinkExistingUsers bool `yaml:"LinkExistingUsers"`
+		// GroupMappings はIdPのグループと組織・役割の対応
+		// ログインの度にこの対応に従って所属する組織と役割を同期する
+		GroupMappings []GroupMapping `yaml:"GroupMappings"`
+		SuccessURL    string         `yaml:"SuccessURL"` // ログイン後にリダイレクトするURL
+	} `yaml:"OIDC"`
+	// LDAP・Active Directoryによる認証 (URL を設定すると有効)
+	// ローカルのパスワードで認証できない場合にLDAPで認証し、初回のログイン時にユーザを作成する
+	LDAP struct {
+		URL      string `yaml:"URL"`      // ldap://host:389 または ldaps://host:636
+		StartTLS bool   `yaml:"StartTLS"` // ldap:// で接続した後にStartTLSする
+		TLS      struct {
+			CACert             string `yaml:"CACert"`             // サーバ証明書を検証するCA証明書のパス (空の場合はシステムの証明書)
+			ServerName         string `yaml:"ServerName"`         // 証明書を検証するホスト名 (空の場合はURLのホスト名)
+			InsecureSkipVerify bool   `yaml:"InsecureSkipVerify"` // 証明書を検証しない (テスト用)
+		} `yaml:"TLS"`
+		BindDN         string        `yaml:"BindDN"`         // ユーザを検索するためのアカウント (空の場合は匿名で検索する)
+		BindPassword   string        `yaml:"BindPassword"`   // BindDN のパスワード
+		BaseDN         string        `yaml:"BaseDN"`         // ユーザを検索する起点
+		UserFilter     string        `yaml:"UserFilter"`     // ユーザを検索するフィルタ (%s はユーザ名に置き換える)
+		GroupAttribute string        `yaml:"GroupAttribute"` // ユーザが所属するグループの属性
+		Timeout        time.Duration `yaml:"Timeout"`        // 接続と各操作のタイムアウト
+		// GroupMappings はグループのDNと組織・役割の対応
+		// ログインの度にこの対応に従って所属する組織と役割を同期する
+		GroupMappings []GroupMapping `yaml:"GroupMappings"`
+	} `yaml:"LDAP"`
+}
+
+// defaultSSHFile は ~/.ssh にあるファイルのうち最初に見つかったもののパスを返す
+// 見つからない場合は空文字列を返す
+func defaultSSHFile(names ...string) string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	for _, name := range names {
+		p := filepath.Join(home, ".ssh", name)
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// GroupMapping は外部の認証基盤のグループと組織・役割の対応
+type GroupMapping struct {
+	Group        string `yaml:"Group"`        // グループ名 (LDAPの場合はグループのDN)
+	Organization uint64 `yaml:"Organization"` // 組織ID
+	Role         string `yaml:"Role"`         // 組織での役割 (viewer, operator, admin)
 }
 
 func Load(path string) (*Config, error) {
@@ -41,5 +156,191 @@ func Load(path string) (*Config, error) {
 		conf.RefreshToken.Duration = time.Hour * 24 * 7 // Default 7d
 	}
 
+	if conf.RefreshToken.CleanupInterval < 1 {
+		conf.RefreshToken.CleanupInterval = time.Hour
+	}
+
+	switch conf.Hypervisor.Executor {
+	case "":
+		conf.Hypervisor.Executor = "ssh"
+	case "ssh", "local":
+	default:
+		return nil, errors.New("Hypervisor.Executor must be ssh or local")
+	}
+
+	if conf.Hypervisor.User == "" {
+		conf.Hypervisor.User = "vmmgr"
+	}
+
+	for i, origin := range conf.CORS.AllowOrigins {
+		if origin == "*" {
+			if conf.CORS.AllowCredentials {
+				return nil, errors.New("CORS.AllowOrigins must not contain * when CORS.AllowCredentials is enabled")
+			}
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.TrimSuffix(u.Path, "/") != "" || u.RawQuery != "" {
+			return nil, errors.New("CORS.AllowOrigins: invalid origin " + origin)
+		}
+		conf.CORS.AllowOrigins[i] = strings.ToLower(u.Scheme + "://" + u.Host)
+	}
+
+	if conf.Hypervisor.Executor == "ssh" {
+		if conf.Hypervisor.SSH.PrivateKey == "" {
+			conf.Hypervisor.SSH.PrivateKey = defaultSSHFile("id_ed25519", "id_ecdsa", "id_rsa")
+			if conf.Hypervisor.SSH.PrivateKey == "" {
+				return nil, errors.New("Hypervisor.SSH.PrivateKey is not set and no default key was found in ~/.ssh")
+			}
+		}
+		if conf.Hypervisor.SSH.KnownHosts == "" {
+			conf.Hypervisor.SSH.KnownHosts = defaultSSHFile("known_hosts")
+		}
+	}
+
+	if conf.Hypervisor.SSH.Port < 1 {
+		conf.Hypervisor.SSH.Port = 22
+	}
+
+	if conf.Hypervisor.Timeout.Status < 1 {
+		conf.Hypervisor.Timeout.Status = 10 * time.Second
+	}
+
+	if conf.Hypervisor.Timeout.Power < 1 {
+		conf.Hypervisor.Timeout.Power = 30 * time.Second
+	}
+
+	if conf.Hypervisor.Timeout.Display < 1 {
+		conf.Hypervisor.Timeout.Display = 10 * time.Second
+	}
+
+	if conf.Hypervisor.Timeout.Screenshot < 1 {
+		conf.Hypervisor.Timeout.Screenshot = 10 * time.Second
+	}
+
+	if conf.Hypervisor.Concurrency < 1 {
+		conf.Hypervisor.Concurrency = 8
+	}
+
+	if conf.Hypervisor.StatusCacheTTL < 1 {
+		conf.Hypervisor.StatusCacheTTL = 10 * time.Second
+	}
+
+	if conf.Hypervisor.ScreenshotCacheTTL < 1 {
+		conf.Hypervisor.ScreenshotCacheTTL = 10 * time.Second
+	}
+
+	if conf.Console.TicketDuration < 1 {
+		conf.Console.TicketDuration = 30 * time.Second
+	}
+
+	if conf.Console.IdleTimeout < 0 || conf.Console.MaxDuration < 0 {
+		return nil, errors.New("Console.IdleTimeout and Console.MaxDuration must not be negative")
+	}
+
+	if conf.Console.PingInterval < 1 {
+		conf.Console.PingInterval = 30 * time.Second
+	}
+
+	if conf.Console.RecordingDir == "" {
+		conf.Console.RecordingDir = "recordings"
+	}
+
+	if conf.TwoFactor.Issuer == "" {
+		conf.TwoFactor.Issuer = "svmmgr"
+	}
+
+	if conf.TwoFactor.ChallengeDuration < 1 {
+		conf.TwoFactor.ChallengeDuration = 5 * time.Minute
+	}
+
+	if conf.OIDC.Issuer != "" {
+		if conf.OIDC.ClientID == "" || conf.OIDC.RedirectURL == "" {
+			return nil, errors.New("OIDC.ClientID and OIDC.RedirectURL are required when OIDC.Issuer is set")
+		}
+		if len(conf.OIDC.GroupMappings) == 0 {
+			return nil, errors.New("OIDC.GroupMappings is required when OIDC.Issuer is set")
+		}
+		if conf.OIDC.Scopes == nil {
+			conf.OIDC.Scopes = []string{"profile", "email"}
+		}
+		if conf.OIDC.UsernameClaim == "" {
+			conf.OIDC.UsernameClaim = "preferred_username"
+		}
+		if conf.OIDC.GroupsClaim == "" {
+			conf.OIDC.GroupsClaim = "groups"
+		}
+		if conf.OIDC.SuccessURL == "" {
+			conf.OIDC.SuccessURL = "/"
+		}
+	}
+
+	if conf.LDAP.URL != "" {
+		u, err := url.Parse(conf.LDAP.URL)
+		if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+			return nil, errors.New("LDAP.URL must be ldap://host[:port] or ldaps://host[:port]")
+		}
+		if conf.LDAP.StartTLS && u.Scheme == "ldaps" {
+			return nil, errors.New("LDAP.StartTLS cannot be used with ldaps://")
+		}
+		if conf.LDAP.BaseDN == "" {
+			return nil, errors.New("LDAP.BaseDN is required when LDAP.URL is set")
+		}
+		if len(conf.LDAP.GroupMappings) == 0 {
+			return nil, errors.New("LDAP.GroupMappings is required when LDAP.URL is set")
+		}
+		if conf.LDAP.UserFilter == "" {
+			conf.LDAP.UserFilter = "(uid=%s)"
+		}
+		if strings.Count(conf.LDAP.UserFilter, "%s") != 1 {
+			return nil, errors.New("LDAP.UserFilter must contain exactly one %s")
+		}
+		if conf.LDAP.GroupAttribute == "" {
+			conf.LDAP.GroupAttribute = "memberOf"
+		}
+		if conf.LDAP.Timeout < 1 {
+			conf.LDAP.Timeout = 10 * time.Second
+		}
+	}
+
+	if conf.Hypervisor.VNC.Mode == "" {
+		conf.Hypervisor.VNC.Mode = VNCModeDirect
+	}
+	for host, mode := range conf.Hypervisor.VNC.Hosts {
+		if mode != VNCModeDirect && mode != VNCModeSSH {
+			return nil, errors.New("Hypervisor.VNC.Hosts." + host + " must be direct or ssh")
+		}
+	}
+	if conf.Hypervisor.VNC.Mode != VNCModeDirect && conf.Hypervisor.VNC.Mode != VNCModeSSH {
+		return nil, errors.New("Hypervisor.VNC.Mode must be direct or ssh")
+	}
+
 	return &conf, nil
 }
+
+const (
+	VNCModeDirect = "direct"
+	VNCModeSSH    = "ssh"
+)
+
+// VNCMode はホストへのVNCの接続方法を返す
+func (c *Config) VNCMode(host string) string {
+	if mode, ok := c.Hypervisor.VNC.Hosts[host]; ok {
+		return mode
+	}
+	if c.Hypervisor.VNC.Mode == "" {
+		return VNCModeDirect
+	}
+	return c.Hypervisor.VNC.Mode
+}
+
+// AllowOrigin はクロスオリジンのリクエストを許可するオリジンかを返す
+func (c *Config) AllowOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, o := range c.CORS.AllowOrigins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,228 @@
+package console
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// 録画ファイルの形式
+//
+// 先頭に recordingMagic を置き、その後にフレームを順に並べる
+//
+//	方向      1バイト (DirOut: サーバ → クライアント, DirIn: クライアント → サーバ)
+//	経過時間  8バイト (セッション開始からのマイクロ秒, ビッグエンディアン)
+//	長さ      4バイト (ビッグエンディアン)
+//	データ    長さ分のバイト列
+const recordingMagic = "SVMREC1\n"
+
+// Direction はフレームのデータの向き
+type Direction byte
+
+const (
+	DirOut Direction = 0 // サーバ → クライアント
+	DirIn  Direction = 1 // クライアント → サーバ
+)
+
+// maxFrameSize は読み込みを許可するフレームの最大長
+const maxFrameSize = 16 * 1024 * 1024
+
+// Frame は録画の1フレーム
+type Frame struct {
+	Dir    Direction
+	Offset time.Duration // セッション開始からの経過時間
+	Data   []byte
+}
+
+// Recorder はセッションのバイト列をタイムスタンプ付きでファイルに書き込む
+type Recorder struct {
+	mu    sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+	size  int64
+	err   error
+}
+
+// CreateRecording は録画ファイルを作成する
+// ディレクトリが存在しない場合は作成する
+func CreateRecording(path string) (*Recorder, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	r := &Recorder{f: f, w: bufio.NewWriter(f), start: time.Now()}
+	if _, err := r.w.WriteString(recordingMagic); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Record はフレームを1つ書き込む
+// 一度書き込みに失敗すると以降は同じエラーを返す
+func (r *Recorder) Record(dir Direction, p []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+
+	var hdr [13]byte
+	hdr[0] = byte(dir)
+	binary.BigEndian.PutUint64(hdr[1:9], uint64(time.Since(r.start).Microseconds()))
+	binary.BigEndian.PutUint32(hdr[9:13], uint32(len(p)))
+	if _, err := r.w.Write(hdr[:]); err != nil {
+		r.err = err
+		return err
+	}
+	if _, err := r.w.Write(p); err != nil {
+		r.err = err
+		return err
+	}
+	// 異常終了時に失われないよう都度書き出す
+	if err := r.w.Flush(); err != nil {
+		r.err = err
+		return err
+	}
+	r.size += int64(len(p))
+	return nil
+}
+
+// Size は記録したデータの合計バイト数を返す
+func (r *Recorder) Size() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.size
+}
+
+// Close はファイルを閉じる
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil {
+		r.f.Close()
+		return err
+	}
+	return r.f.Close()
+}
+
+// Tee は w への書き込みを dir の向きで記録する Writer を返す
+// 記録に失敗した場合は書き込みもエラーにする
+func (r *Recorder) Tee(dir Direction, w io.Writer) io.Writer {
+	return &teeWriter{r: r, dir: dir, w: w}
+}
+
+type teeWriter struct {
+	r   *Recorder
+	dir Direction
+	w   io.Writer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	n, err := t.w.Write(p)
+	if n > 0 {
+		if rerr := t.r.Record(t.dir, p[:n]); rerr != nil {
+			return n, fmt.Errorf("recording failed: %w", rerr)
+		}
+	}
+	return n, err
+}
+
+// RecordingReader は録画ファイルからフレームを読み込む
+type RecordingReader struct {
+	f *os.File
+	r *bufio.Reader
+}
+
+// OpenRecording は録画ファイルを開く
+func OpenRecording(path string) (*RecordingReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(recordingMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != recordingMagic {
+		f.Close()
+		return nil, errors.New("invalid recording file")
+	}
+	return &RecordingReader{f: f, r: r}, nil
+}
+
+// Next は次のフレームを返す
+// 最後まで読み込んだ場合は io.EOF を返す
+func (rr *RecordingReader) Next() (*Frame, error) {
+	var hdr [13]byte
+	if _, err := io.ReadFull(rr.r, hdr[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// 書き込み途中で終了した録画は途中までを有効とする
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[9:13])
+	if n > maxFrameSize {
+		return nil, errors.New("frame is too large")
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(rr.r, data); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return &Frame{
+		Dir:    Direction(hdr[0]),
+		Offset: time.Duration(binary.BigEndian.Uint64(hdr[1:9])) * time.Microsecond,
+		Data:   data,
+	}, nil
+}
+
+func (rr *RecordingReader) Close() error {
+	return rr.f.Close()
+}
+
+// Replay はサーバ → クライアントのフレームを記録時の間隔の 1/speed で send に渡す
+func Replay(ctx context.Context, rr *RecordingReader, speed float64, send func([]byte) error) error {
+	if speed <= 0 {
+		return errors.New("speed must be positive")
+	}
+	start := time.Now()
+	for {
+		frame, err := rr.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if frame.Dir != DirOut {
+			continue
+		}
+
+		wait := time.Duration(float64(frame.Offset)/speed) - time.Since(start)
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		}
+		if err := send(frame.Data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package console
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session は接続中のコンソール(VNC・シリアルコンソール)のセッション
+type Session struct {
+	ID             string
+	Kind           string // vnc, console
+	UserID         uint64
+	Username       string
+	OrganizationID uint64
+	ServerID       uint64
+	ServerName     string
+	RemoteAddr     string
+	TokenID        string // 接続に使ったアクセストークンのID (リフレッシュトークンのファミリー)
+	StartedAt      time.Time
+
+	bytesIn     atomic.Int64 // クライアント → サーバ
+	bytesOut    atomic.Int64 // サーバ → クライアント
+	lastInputAt atomic.Int64 // 最後にクライアントから入力があった日時 (UnixNano)
+
+	closeOnce sync.Once
+	done      chan struct{}
+	reason    string
+}
+
+// SessionInfo はAPIで返すセッションの情報
+type SessionInfo struct {
+	ID             string    `json:"id"`
+	Kind           string    `json:"kind"`
+	UserID         uint64    `json:"user_id"`
+	Username       string    `json:"username"`
+	OrganizationID uint64    `json:"organization_id"`
+	ServerID       uint64    `json:"server_id"`
+	ServerName     string    `json:"server_name"`
+	RemoteAddr     string    `json:"remote_addr"`
+	StartedAt      time.Time `json:"started_at"`
+	LastInputAt    time.Time `json:"last_input_at"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+}
+
+// AddIn はクライアントから受け取ったバイト数を加算する
+func (s *Session) AddIn(n int) {
+	s.bytesIn.Add(int64(n))
+	s.lastInputAt.Store(time.Now().UnixNano())
+}
+
+// CountIn はクライアントから受け取ったバイト数を入力とみなさずに加算する
+func (s *Session) CountIn(n int) { s.bytesIn.Add(int64(n)) }
+
+// AddOut はクライアントへ送ったバイト数を加算する
+func (s *Session) AddOut(n int) { s.bytesOut.Add(int64(n)) }
+
+// LastInputAt は最後にクライアントから入力があった日時を返す
+// 入力がない場合は開始日時を返す
+func (s *Session) LastInputAt() time.Time {
+	return time.Unix(0, s.lastInputAt.Load())
+}
+
+// Done はセッションが外部から切断されると閉じられる
+func (s *Session) Done() <-chan struct{} { return s.done }
+
+// Close はセッションの切断を要求する
+func (s *Session) Close(reason string) {
+	s.closeOnce.Do(func() {
+		s.reason = reason
+		close(s.done)
+	})
+}
+
+// Reason は切断された理由を返す
+// Done が閉じられた後に呼び出すこと
+func (s *Session) Reason() string {
+	return s.reason
+}
+
+func (s *Session) Info() SessionInfo {
+	return SessionInfo{
+		ID:             s.ID,
+		Kind:           s.Kind,
+		UserID:         s.UserID,
+		Username:       s.Username,
+		OrganizationID: s.OrganizationID,
+		ServerID:       s.ServerID,
+		ServerName:     s.ServerName,
+		RemoteAddr:     s.RemoteAddr,
+		StartedAt:      s.StartedAt,
+		LastInputAt:    s.LastInputAt(),
+		BytesIn:        s.bytesIn.Load(),
+		BytesOut:       s.bytesOut.Load(),
+	}
+}
+
+// Registry はプロセス内の接続中のセッションを管理する
+type Registry struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[string]*Session)}
+}
+
+// Add はセッションを登録する
+// ID と StartedAt は自動で設定される
+func (r *Registry) Add(s *Session) (*Session, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	s.ID = hex.EncodeToString(b)
+	s.StartedAt = time.Now()
+	s.lastInputAt.Store(s.StartedAt.UnixNano())
+	s.done = make(chan struct{})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sessions[s.ID] = s
+	return s, nil
+}
+
+// Remove はセッションの登録を解除する
+func (r *Registry) Remove(s *Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.sessions, s.ID)
+}
+
+// Get はIDに対応するセッションを返す
+func (r *Registry) Get(id string) (*Session, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.sessions[id]
+	return s, ok
+}
+
+// List は条件に一致するセッションを開始日時順に返す
+func (r *Registry) List(match func(*Session) bool) []SessionInfo {
+	r.mu.Lock()
+	var list []*Session
+	for _, s := range r.sessions {
+		if match(s) {
+			list = append(list, s)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].StartedAt.Before(list[j].StartedAt) })
+	infos := make([]SessionInfo, 0, len(list))
+	for _, s := range list {
+		infos = append(infos, s.Info())
+	}
+	return infos
+}
+
+// CloseMatching は条件に一致するセッションを切断し、切断した数を返す
+func (r *Registry) CloseMatching(match func(*Session) bool, reason string) int {
+	r.mu.Lock()
+	var list []*Session
+	for _, s := range r.sessions {
+		if match(s) {
+			list = append(list, s)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, s := range list {
+		s.Close(reason)
+	}
+	return len(list)
+}
+
+// CloseByServer はサーバのセッションを全て切断する
+func (r *Registry) CloseByServer(serverID uint64, reason string) int {
+	return r.CloseMatching(func(s *Session) bool { return s.ServerID == serverID }, reason)
+}
+
+// CloseByToken はリフレッシュトークンのファミリーから発行されたアクセストークンで開始したセッションを切断する
+func (r *Registry) CloseByToken(tokenID string, reason string) int {
+	if tokenID == "" {
+		return 0
+	}
+	return r.CloseMatching(func(s *Session) bool { return s.TokenID == tokenID }, reason)
+}
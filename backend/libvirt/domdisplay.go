@@ -0,0 +1,53 @@
+package libvirt
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type DomDisplay struct {
+	URI     string `json:"uri"`     // vnc://127.0.0.1:0 など
+	Type    string `json:"type"`    // vnc, spice
+	Host    string `json:"host"`    // 待ち受けアドレス
+	Display int    `json:"display"` // VNCのディスプレイ番号 (spiceの場合は0)
+	Port    int    `json:"port"`    // TCPポート番号
+}
+
+// VNCのディスプレイ番号0に対応するポート番号
+const vncBasePort = 5900
+
+func ParseDomDisplay(data string) (DomDisplay, error) {
+	uri := strings.TrimSpace(data)
+	if i := strings.IndexByte(uri, '\n'); i >= 0 {
+		uri = strings.TrimSpace(uri[:i])
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return DomDisplay{}, err
+	}
+	host, portStr, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		return DomDisplay{}, fmt.Errorf("invalid domdisplay output: %s", uri)
+	}
+	n, err := strconv.Atoi(portStr)
+	if err != nil {
+		return DomDisplay{}, fmt.Errorf("invalid domdisplay output: %s", uri)
+	}
+
+	d := DomDisplay{URI: uri, Type: u.Scheme, Host: host}
+	switch u.Scheme {
+	case "vnc":
+		// vncのURIはディスプレイ番号を表す
+		d.Display = n
+		d.Port = vncBasePort + n
+	case "spice":
+		d.Port = n
+	default:
+		return DomDisplay{}, fmt.Errorf("unsupported display type: %s", u.Scheme)
+	}
+	return d, nil
+}
@@ -0,0 +1,39 @@
+package libvirt
+
+import (
+	"testing"
+)
+
+func TestParseDomDisplay(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected DomDisplay
+	}{
+		{
+			data:     "vnc://127.0.0.1:1\n\n",
+			expected: DomDisplay{URI: "vnc://127.0.0.1:1", Type: "vnc", Host: "127.0.0.1", Display: 1, Port: 5901},
+		},
+		{
+			data:     "vnc://[::1]:0\n",
+			expected: DomDisplay{URI: "vnc://[::1]:0", Type: "vnc", Host: "::1", Display: 0, Port: 5900},
+		},
+		{
+			data:     "spice://localhost:5930\n",
+			expected: DomDisplay{URI: "spice://localhost:5930", Type: "spice", Host: "localhost", Port: 5930},
+		},
+	}
+
+	for _, tt := range tests {
+		d, err := ParseDomDisplay(tt.data)
+		if err != nil {
+			t.Fatalf("ParseDomDisplay(%q) failed: %v", tt.data, err)
+		}
+		if d != tt.expected {
+			t.Errorf("ParseDomDisplay result mismatch\nGot: %+v\nWant: %+v", d, tt.expected)
+		}
+	}
+
+	if _, err := ParseDomDisplay("error: failed to get domain 'vm1'\n"); err == nil {
+		t.Error("ParseDomDisplay succeeded with invalid output")
+	}
+}
@@ -7,19 +7,19 @@ import (
 )
 
 type DomInfo struct {
-	ID            string // "-" や数値が入る可能性あり
-	Name          string
-	UUID          string
-	OSType        string
-	State         string
-	CPUs          int
-	MaxMemory     int64 // KiB 単位
-	UsedMemory    int64 // KiB 単位
-	Persistent    bool
-	Autostart     bool
-	ManagedSave   bool
-	SecurityModel string
-	SecurityDOI   int
+	ID            string `json:"id"` // "-" や数値が入る可能性あり
+	Name          string `json:"name"`
+	UUID          string `json:"uuid"`
+	OSType        string `json:"os_type"`
+	State         string `json:"state"`
+	CPUs          int    `json:"cpus"`
+	MaxMemory     int64  `json:"max_memory"`  // KiB 単位
+	UsedMemory    int64  `json:"used_memory"` // KiB 単位
+	Persistent    bool   `json:"persistent"`
+	Autostart     bool   `json:"autostart"`
+	ManagedSave   bool   `json:"managed_save"`
+	SecurityModel string `json:"security_model"`
+	SecurityDOI   int    `json:"security_doi"`
 }
 
 func ParseDomInfo(data string) (DomInfo, error) {
@@ -0,0 +1,63 @@
+package libvirt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResultVersion は virsh-wrapper --json が出力する形式のバージョン
+const ResultVersion = 1
+
+// ExitDenied は virsh-wrapper がポリシーで拒否した場合の終了コード (EX_NOPERM)
+const ExitDenied = 77
+
+// ErrDenied は virsh-wrapper のポリシーで拒否されたことを表す
+var ErrDenied = errors.New("denied by virsh-wrapper policy")
+
+// Result は virsh-wrapper --json が出力する実行結果
+type Result struct {
+	Version  int             `json:"version"`
+	Command  string          `json:"command"`
+	Domain   string          `json:"domain"`
+	ExitCode int             `json:"exit_code"`
+	Stdout   string          `json:"stdout"`
+	Stderr   string          `json:"stderr"`
+	Parsed   json.RawMessage `json:"parsed,omitempty"` // コマンドごとの解析結果
+	Data     []byte          `json:"data,omitempty"`   // バイナリの出力 (screenshot の画像、base64)
+}
+
+func ParseResult(data []byte) (Result, error) {
+	var r Result
+	if err := json.Unmarshal(data, &r); err != nil {
+		return Result{}, fmt.Errorf("invalid virsh-wrapper output: %w", err)
+	}
+	if r.Version != ResultVersion {
+		return Result{}, fmt.Errorf("unsupported virsh-wrapper output version: %d", r.Version)
+	}
+	return r, nil
+}
+
+// Err はコマンドが失敗していればエラーを返す
+func (r Result) Err() error {
+	if r.ExitCode == 0 {
+		return nil
+	}
+	if r.ExitCode == ExitDenied {
+		return fmt.Errorf("%w: %s", ErrDenied, strings.TrimSpace(r.Stderr))
+	}
+	msg := strings.TrimSpace(r.Stderr)
+	if msg == "" {
+		msg = fmt.Sprintf("exit status %d", r.ExitCode)
+	}
+	return fmt.Errorf("%s %s: %s", r.Command, r.Domain, msg)
+}
+
+// Decode は解析結果を v に展開する
+func (r Result) Decode(v any) error {
+	if len(r.Parsed) == 0 {
+		return errors.New("no parsed output for " + r.Command)
+	}
+	return json.Unmarshal(r.Parsed, v)
+}
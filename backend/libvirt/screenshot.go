@@ -0,0 +1,98 @@
+package libvirt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// pngSignature はPNGファイルの先頭のシグネチャ
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// DecodeScreenshot は virsh screenshot の画像を読み込む
+// QEMUのバージョンによりPNGまたはPPM(P6)で出力されるため両方に対応する
+func DecodeScreenshot(data []byte) (image.Image, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte(pngSignature)):
+		return png.Decode(bytes.NewReader(data))
+	case bytes.HasPrefix(data, []byte("P6")):
+		return decodePPM(bytes.NewReader(data))
+	}
+	return nil, errors.New("unsupported screenshot format")
+}
+
+// decodePPM はバイナリ形式(P6)のPPMを読み込む
+func decodePPM(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+
+	// ヘッダは "P6 <幅> <高さ> <最大値>" で、空白区切り・#以降はコメント
+	var fields []int
+	magic, err := ppmToken(br)
+	if err != nil || magic != "P6" {
+		return nil, errors.New("invalid PPM header")
+	}
+	for len(fields) < 3 {
+		tok, err := ppmToken(br)
+		if err != nil {
+			return nil, errors.New("invalid PPM header")
+		}
+		var v int
+		if _, err := fmt.Sscanf(tok, "%d", &v); err != nil || v < 1 {
+			return nil, fmt.Errorf("invalid PPM header value: %q", tok)
+		}
+		fields = append(fields, v)
+	}
+	width, height, maxVal := fields[0], fields[1], fields[2]
+	if maxVal > 255 {
+		return nil, errors.New("16-bit PPM is not supported")
+	}
+	if width > 16384 || height > 16384 {
+		return nil, errors.New("PPM image is too large")
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	row := make([]byte, width*3)
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(br, row); err != nil {
+			return nil, fmt.Errorf("truncated PPM data: %w", err)
+		}
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{
+				R: uint8(int(row[x*3]) * 255 / maxVal),
+				G: uint8(int(row[x*3+1]) * 255 / maxVal),
+				B: uint8(int(row[x*3+2]) * 255 / maxVal),
+				A: 255,
+			})
+		}
+	}
+	return img, nil
+}
+
+// ppmToken はPPMヘッダの次のトークンを返す
+// トークンの直後の空白1文字も読み捨てる
+func ppmToken(br *bufio.Reader) (string, error) {
+	var tok []byte
+	for {
+		c, err := br.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == '#' && len(tok) == 0:
+			if _, err := br.ReadString('\n'); err != nil {
+				return "", err
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if len(tok) > 0 {
+				return string(tok), nil
+			}
+		default:
+			tok = append(tok, c)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package libvirt
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestDecodeScreenshot(t *testing.T) {
+	// 2x1 のPPM (コメント付き)
+	ppm := []byte("P6\n# CREATOR: qemu\n2 1\n255\n\xff\x00\x00\x00\x00\xff")
+	img, err := DecodeScreenshot(ppm)
+	if err != nil {
+		t.Fatalf("DecodeScreenshot(ppm) failed: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 1 {
+		t.Fatalf("unexpected bounds: %v", b)
+	}
+	if got := color.RGBAModel.Convert(img.At(0, 0)); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("pixel(0,0) = %v", got)
+	}
+	if got := color.RGBAModel.Convert(img.At(1, 0)); got != (color.RGBA{B: 255, A: 255}) {
+		t.Errorf("pixel(1,0) = %v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	img, err = DecodeScreenshot(buf.Bytes())
+	if err != nil {
+		t.Fatalf("DecodeScreenshot(png) failed: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 3 || b.Dy() != 2 {
+		t.Errorf("unexpected bounds: %v", b)
+	}
+
+	for _, data := range []string{"", "GIF89a", "P6\n2 1\n255\n\xff\x00"} {
+		if _, err := DecodeScreenshot([]byte(data)); err == nil {
+			t.Errorf("DecodeScreenshot(%q) succeeded with invalid data", data)
+		}
+	}
+}
@@ -7,18 +7,87 @@ import (
 )
 
 func Migrate(db *gorm.DB) error {
+	// 役割が導入される前のユーザは従来通り全ての操作を行えるよう admin にする
+	// 役割の列を追加すると既定の viewer になるため、追加する前に確認しておく
+	legacyUsers := db.Migrator().HasTable(&User{}) && !db.Migrator().HasColumn(&User{}, "Role")
+
 	// マイグレーションを実行
-	return db.AutoMigrate(
+	err := db.AutoMigrate(
 		&User{},
-		//&APIToken{},
+		&APIToken{},
 		&Organization{},
 		&Server{},
 		&RefreshToken{},
+		&HostKey{},
+		&ConsoleRecording{},
+		&Group{},
+		&GroupMember{},
+		&ServerGrant{},
+		&Membership{},
+		&RecoveryCode{},
 	)
+	if err != nil {
+		return err
+	}
+
+	if legacyUsers {
+		return db.Exec("UPDATE users SET role = ?", RoleAdmin).Error
+	}
+	return nil
 }
 
+// Permissions は組織内での操作の権限
 type Permissions string
 
+const (
+	PermissionView       Permissions = "view"        // サーバの参照
+	PermissionPower      Permissions = "power"       // 起動・停止・再起動
+	PermissionForcePower Permissions = "force-power" // 強制停止・強制再起動
+	PermissionConsole    Permissions = "console"     // VNC・シリアルコンソールへの接続
+	PermissionManage     Permissions = "manage"      // コンソールセッション・録画・ユーザの管理
+)
+
+// Role は組織内でのユーザの役割
+type Role string
+
+const (
+	RoleViewer   Role = "viewer"   // 参照のみ
+	RoleOperator Role = "operator" // 参照・電源操作・コンソール
+	RoleAdmin    Role = "admin"    // 全ての操作
+)
+
+// rolePermissions は役割ごとの権限
+var rolePermissions = map[Role][]Permissions{
+	RoleViewer:   {PermissionView},
+	RoleOperator: {PermissionView, PermissionPower, PermissionConsole},
+	RoleAdmin:    {PermissionView, PermissionPower, PermissionForcePower, PermissionConsole, PermissionManage},
+}
+
+// Valid は定義されている役割かを返す
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// Permissions は役割が持つ権限の一覧を返す
+func (r Role) Permissions() []Permissions {
+	return append([]Permissions{}, rolePermissions[r]...)
+}
+
+// Has は役割が権限を持つかを返す
+func (r Role) Has(p Permissions) bool {
+	for _, v := range rolePermissions[r] {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// GrantablePermissions はサーバ単位で付与できる権限
+// manage は組織全体に対する権限のため付与できない
+var GrantablePermissions = []Permissions{PermissionView, PermissionPower, PermissionForcePower, PermissionConsole}
+
 type Model struct {
 	ID        uint64          `gorm:"primaryKey;autoIncrement:true" json:"id"`
 	CreatedAt time.Time       `gorm:"autoCreateTime" json:"created_at"`
@@ -28,24 +97,74 @@ type Model struct {
 
 type User struct {
 	Model
-	Username string `gorm:"size:64;uniqueIndex;not null" json:"username"` // ユーザ名
-	Password string `gorm:"size:64;not null" json:"password"`             // パスワード
-	//APITokenID     *uint64 `json:"api_token_id"`                                 // APIキーID
-	OrganizationID uint64 `gorm:"not null; index" json:"organization_id"` // 組織ID
+	Username       string `gorm:"size:64;uniqueIndex;not null" json:"username"` // ユーザ名
+	Password       string `gorm:"size:64;not null" json:"-"`                    // パスワード
+	OrganizationID uint64 `gorm:"not null; index" json:"organization_id"`       // 既定の組織ID (他の組織には Membership で所属する)
+	// 役割を指定せずに作成したユーザが組織の管理者にならないよう既定は viewer
+	// 役割が導入される前のユーザは Migrate で admin にする
+	Role Role `gorm:"size:16;not null;default:viewer" json:"role"` // 組織内での役割
+	// Restricted が true の場合は役割に関わらず ServerGrant で付与されたサーバのみ操作できる
+	Restricted bool `gorm:"not null;default:false" json:"restricted"`
+
+	// TOTPによる二段階認証 (RFC 6238)
+	TOTPSecret   string `gorm:"size:64" json:"-"`                           // Base32のシークレット (登録中も設定される)
+	TOTPEnabled  bool   `gorm:"not null;default:false" json:"totp_enabled"` // 確認済みで有効か
+	TOTPLastStep int64  `gorm:"not null;default:0" json:"-"`                // 最後に使われたコードのステップ (再利用の防止)
+
+	// OIDCSubject はOpenID Connectでログインするユーザの IdP での識別子 (sub クレーム)
+	OIDCSubject *string `gorm:"column:oidc_subject;size:255;uniqueIndex" json:"-"`
+	// LDAPDN はLDAPでログインするユーザのDN (小文字に正規化する)
+	// LDAPのユーザはユーザ名ではなくDNで照合し、他の方法で作成されたユーザと区別する
+	LDAPDN *string `gorm:"column:ldap_dn;size:255;uniqueIndex" json:"-"`
+}
+
+// RecoveryCode は認証アプリを使えない場合に1度だけ使える二段階認証のコード
+type RecoveryCode struct {
+	Model
+	UserID   uint64     `gorm:"not null; index" json:"user_id"` // ユーザID
+	CodeHash string     `gorm:"size:64;not null" json:"-"`      // コードのSHA-256
+	UsedAt   *time.Time `json:"used_at"`                        // 使用日時
+}
+
+// Membership はユーザが所属する組織 (User.OrganizationID の組織以外) と、その組織での役割
+type Membership struct {
+	Model
+	UserID         uint64 `gorm:"not null; uniqueIndex:idx_membership" json:"user_id"`         // ユーザID
+	OrganizationID uint64 `gorm:"not null; uniqueIndex:idx_membership" json:"organization_id"` // 組織ID
+	Role           Role   `gorm:"size:16;not null" json:"role"`                                // 組織内での役割
+	Restricted     bool   `gorm:"not null;default:false" json:"restricted"`                    // 権限を付与されたサーバのみ操作できるか
+}
+
+// OrgPermissions はユーザが組織の全てのサーバに対して持つ権限を返す
+// 制限付きユーザは付与されたサーバ以外に対する権限を持たない
+func (u *User) OrgPermissions() []Permissions {
+	if u.Restricted {
+		return nil
+	}
+	return u.Role.Permissions()
 }
 
-/*
+// APIToken は自動化用の個人APIトークン
+// Authorization: ApiKey <AccessToken>:<シークレット> で認証する
 type APIToken struct {
 	Model
-	AccessToken string `gorm:"size:64;not null; index" json:"access_token"` // アクセストークン
-	SecretToken string `gorm:"size:72;not null" json:"secret_token"`        // シークレットトークン
+	UserID      uint64     `gorm:"not null; index" json:"user_id"`                    // 所有するユーザID
+	Name        string     `gorm:"size:64;not null" json:"name"`                      // トークン名
+	AccessToken string     `gorm:"size:64;not null; uniqueIndex" json:"access_token"` // アクセストークン
+	SecretToken string     `gorm:"size:72;not null" json:"-"`                         // シークレットトークンのbcryptハッシュ
+	Scopes      string     `gorm:"size:256;not null" json:"-"`                        // スペース区切りのスコープ
+	ExpiresAt   *time.Time `json:"expires_at"`                                        // 有効期限 (nullは無期限)
+	LastUsedAt  *time.Time `json:"last_used_at"`                                      // 最終使用日時
 }
-*/
 
 type Organization struct {
 	Model
 	Name        string `gorm:"size:64;not null" json:"name"` // 組織名
 	Description string `gorm:"size:256" json:"description"`  // 組織の説明
+
+	RecordConsole bool `gorm:"not null;default:false" json:"record_console"` // VNCコンソールの操作を録画するか
+	// RequireTwoFactor が true の場合、組織のメンバーはログイン時に二段階認証を必須とする
+	RequireTwoFactor bool `gorm:"not null;default:false" json:"require_two_factor"`
 }
 
 type Server struct {
@@ -53,6 +172,13 @@ type Server struct {
 	Name           string `gorm:"size:64;not null" json:"name"`           // VMサーバ名
 	HostName       string `gorm:"size:64;not null" json:"host_name"`      // ホスト名
 	OrganizationID uint64 `gorm:"not null; index" json:"organization_id"` // 組織ID
+
+	// 以下はReconcilerがハイパーバイザから取得した最新の情報
+	State      string     `gorm:"size:32" json:"state"`    // 電源状態
+	CPUs       int        `gorm:"column:cpus" json:"cpus"` // CPU数
+	MaxMemory  int64      `json:"max_memory"`              // 最大メモリ (KiB)
+	UUID       string     `gorm:"size:36" json:"uuid"`     // ドメインのUUID
+	LastSeenAt *time.Time `json:"last_seen_at"`            // 最後に情報を取得できた日時
 }
 
 type RefreshToken struct {
@@ -60,4 +186,56 @@ type RefreshToken struct {
 	Token     string    `gorm:"size:64:not null uniqueIndex" json:"token"` // リフレッシュトークン
 	UserID    uint64    `gorm:"not null; index" json:"user_id"`            // ユーザID
 	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`                // トークンの有効期限
+	// Family はログイン時に発行したトークンと、それをローテーションしたトークンに共通のID
+	// アクセストークンのIDとして使い、再利用を検出した場合はファミリーごと失効する
+	Family    string     `gorm:"size:64;not null;default:'';index" json:"-"`
+	RotatedAt *time.Time `json:"-"` // ローテーションで新しいトークンに置き換えられた日時
+
+	// セッションの一覧に表示する情報 (ローテーションの度に更新する)
+	UserAgent  string     `gorm:"size:255;not null;default:''" json:"-"` // ログイン・リフレッシュしたブラウザ
+	IPAddress  string     `gorm:"size:64;not null;default:''" json:"-"`  // ログイン・リフレッシュした接続元
+	LastUsedAt *time.Time `json:"-"`                                     // 最後にリフレッシュした日時
+}
+
+type HostKey struct {
+	Model
+	HostName  string `gorm:"size:64;not null; index" json:"host_name"` // ホスト名
+	PublicKey string `gorm:"size:1024;not null" json:"public_key"`     // authorized_keys形式の公開鍵
+}
+
+type ConsoleRecording struct {
+	Model
+	OrganizationID uint64     `gorm:"not null; index" json:"organization_id"` // 組織ID
+	ServerID       uint64     `gorm:"not null; index" json:"server_id"`       // サーバID
+	ServerName     string     `gorm:"size:64;not null" json:"server_name"`    // 録画時のVMサーバ名
+	UserID         uint64     `gorm:"not null" json:"user_id"`                // 操作したユーザID
+	Username       string     `gorm:"size:64;not null" json:"username"`       // 操作したユーザ名
+	SessionID      string     `gorm:"size:32;not null" json:"session_id"`     // コンソールセッションID
+	Path           string     `gorm:"size:1024;not null" json:"-"`            // 録画ファイルのパス
+	StartedAt      time.Time  `gorm:"not null" json:"started_at"`             // 録画開始日時
+	EndedAt        *time.Time `json:"ended_at"`                               // 録画終了日時 (録画中はnull)
+	Size           int64      `json:"size"`                                   // 記録したデータのバイト数
+}
+
+// Group は権限を付与するためのユーザのグループ
+type Group struct {
+	Model
+	OrganizationID uint64 `gorm:"not null; index" json:"organization_id"` // 組織ID
+	Name           string `gorm:"size:64;not null" json:"name"`           // グループ名
+}
+
+type GroupMember struct {
+	Model
+	GroupID uint64 `gorm:"not null; uniqueIndex:idx_group_member" json:"group_id"` // グループID
+	UserID  uint64 `gorm:"not null; uniqueIndex:idx_group_member" json:"user_id"`  // ユーザID
+}
+
+// ServerGrant はユーザまたはグループにサーバ単位で付与する権限
+// 役割の権限に加算され、制限付きユーザはこの権限のみを持つ
+type ServerGrant struct {
+	Model
+	ServerID    uint64  `gorm:"not null; index" json:"server_id"` // サーバID
+	UserID      *uint64 `gorm:"index" json:"user_id"`             // 付与先のユーザID
+	GroupID     *uint64 `gorm:"index" json:"group_id"`            // 付与先のグループID
+	Permissions string  `gorm:"size:256;not null" json:"-"`       // スペース区切りの権限
 }
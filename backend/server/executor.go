@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+
+	"github.com/caarlos0/go-shellwords"
+)
+
+// Executor はハイパーバイザ上でコマンドを実行するためのインターフェース
+// SSH経由・ローカル実行・テスト用のフェイクを差し替えられるようにする
+type Executor interface {
+	// 標準出力のみを返し、コマンドが失敗した場合は標準エラー出力を含む *ExecError を返す
+	// ctx がキャンセルされた場合は実行中のコマンドを中断して ctx.Err() を返す
+	Exec(ctx context.Context, host, command string) ([]byte, error)
+}
+
+// ExecError はコマンドが失敗した場合のエラー
+type ExecError struct {
+	Err    error
+	Stderr []byte // コマンドの標準エラー出力
+}
+
+func (e *ExecError) Error() string {
+	if msg := strings.TrimSpace(string(e.Stderr)); msg != "" {
+		return e.Err.Error() + ": " + msg
+	}
+	return e.Err.Error()
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Stream は端末を割り当てて実行中のコマンドの入出力
+type Stream interface {
+	io.ReadWriteCloser
+	// Resize は端末のサイズを変更する
+	Resize(cols, rows int) error
+}
+
+// StreamExecutor は端末を割り当てて対話的にコマンドを実行できるExecutor
+type StreamExecutor interface {
+	Executor
+	// Stream はコマンドを開始して入出力を返す
+	// ctx は接続の確立にのみ使われ、開始後は Stream の Close で終了する
+	Stream(ctx context.Context, host, command string, cols, rows int) (Stream, error)
+}
+
+// ErrStreamNotSupported はExecutorが対話的な実行に対応していない場合のエラー
+var ErrStreamNotSupported = errors.New("executor does not support interactive sessions")
+
+// TunnelExecutor はホストを経由してTCP接続できるExecutor
+type TunnelExecutor interface {
+	Executor
+	// Dial は host を経由して、host から見た addr に接続する
+	Dial(ctx context.Context, host, addr string) (net.Conn, error)
+}
+
+// ErrTunnelNotSupported はExecutorがトンネル接続に対応していない場合のエラー
+var ErrTunnelNotSupported = errors.New("executor does not support tunneling")
+
+// LocalExecutor はバックエンドと同じホストでコマンドを実行する
+// ホスト名は無視される
+type LocalExecutor struct{}
+
+func (e *LocalExecutor) Exec(ctx context.Context, host, command string) ([]byte, error) {
+	args, err := shellwords.NewParser().Parse(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return stdout.Bytes(), ctx.Err()
+	}
+	if err != nil {
+		return stdout.Bytes(), &ExecError{Err: err, Stderr: stderr.Bytes()}
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLocalExecutor(t *testing.T) {
+	e := &LocalExecutor{}
+
+	// 標準エラー出力は結果に含めない
+	out, err := e.Exec(context.Background(), "", `sh -c "echo out; echo warning >&2"`)
+	if err != nil || string(out) != "out\n" {
+		t.Errorf("Exec = %q, %v", out, err)
+	}
+
+	// 失敗した場合は標準エラー出力をエラーに含める
+	out, err = e.Exec(context.Background(), "", `sh -c "echo out; echo failed >&2; exit 3"`)
+	var execErr *ExecError
+	if !errors.As(err, &execErr) || !strings.Contains(err.Error(), "failed") || string(out) != "out\n" {
+		t.Errorf("Exec = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/masa23/webapp-test/model"
+	"gorm.io/gorm"
+)
+
+// Reconciler は定期的に全サーバのドメイン情報を取得してDBに保存する
+// ハイパーバイザに到達できない場合は前回の情報を残し、LastSeenAt は更新しない
+type Reconciler struct {
+	db       *gorm.DB
+	hv       *Hypervisor
+	interval time.Duration
+
+	running atomic.Bool
+}
+
+func NewReconciler(db *gorm.DB, hv *Hypervisor, interval time.Duration) *Reconciler {
+	return &Reconciler{db: db, hv: hv, interval: interval}
+}
+
+// Run は ctx がキャンセルされるまで定期的に ReconcileAll を実行する
+func (r *Reconciler) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.ReconcileAll(ctx); err != nil {
+			log.Println("reconcile 失敗:", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcileAll は全サーバの情報を更新する
+// 前回の実行が終わっていない場合は何もしない
+func (r *Reconciler) ReconcileAll(ctx context.Context) error {
+	if !r.running.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer r.running.Store(false)
+
+	var servers []model.Server
+	if err := r.db.WithContext(ctx).Find(&servers).Error; err != nil {
+		return err
+	}
+
+	r.hv.forEachByHost(ctx, servers, func(sv model.Server, skip bool) error {
+		if skip {
+			return nil
+		}
+		return r.Reconcile(ctx, sv)
+	})
+	return nil
+}
+
+// ReconcileLater は delay 後に1台のサーバの情報を更新する
+// 電源操作は非同期に状態が変わるため、操作の直後ではなく少し待ってから取得する
+// 状態取得のタイムアウトを超えた場合は中断し、次の定期的な更新に任せる
+func (r *Reconciler) ReconcileLater(sv model.Server, delay time.Duration) {
+	time.AfterFunc(delay, func() {
+		ctx := context.Background()
+		if r.hv.timeouts.Status > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, r.hv.timeouts.Status)
+			defer cancel()
+		}
+		if err := r.Reconcile(ctx, sv); err != nil {
+			log.Println("reconcile 失敗:", err)
+		}
+	})
+}
+
+// Reconcile は1台のサーバの情報を更新する
+func (r *Reconciler) Reconcile(ctx context.Context, sv model.Server) error {
+	info, err := r.hv.ServerDomInfo(ctx, sv)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return r.db.WithContext(ctx).Model(&model.Server{}).Where("id = ?", sv.ID).Updates(map[string]any{
+		"state":        info.State,
+		"cpus":         info.CPUs,
+		"max_memory":   info.MaxMemory,
+		"uuid":         info.UUID,
+		"last_seen_at": &now,
+	}).Error
+}
@@ -0,0 +1,115 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/masa23/webapp-test/model"
+	"github.com/masa23/webapp-test/server"
+	"github.com/masa23/webapp-test/server/servertest"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestReconciler(t *testing.T) {
+	db := newTestDB(t)
+	for _, sv := range []*model.Server{
+		{Model: model.Model{ID: 1}, Name: "vm1", HostName: "kvm1", OrganizationID: 1},
+		{Model: model.Model{ID: 2}, Name: "vm2", HostName: "kvm2", OrganizationID: 1},
+	} {
+		if err := db.Create(sv).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fake := servertest.NewFakeExecutor()
+	fake.AddDomain("kvm1", "vm1", "running", 0)
+	fake.AddDomain("kvm2", "vm2", "shut off", 0)
+	hv := server.NewHypervisor(fake, server.Options{Concurrency: 2, StoredState: true})
+	r := server.NewReconciler(db, hv, time.Minute)
+
+	if err := r.ReconcileAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保存された状態を返す
+	status := func() (model.Server, string) {
+		t.Helper()
+		var sv model.Server
+		if err := db.First(&sv, 1).Error; err != nil {
+			t.Fatal(err)
+		}
+		status, err := hv.ServerStatus(context.Background(), sv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sv, status
+	}
+	sv, st := status()
+	if st != "running" || sv.CPUs != 1 || sv.MaxMemory != 1048576 || sv.LastSeenAt == nil {
+		t.Errorf("unexpected server: %s %+v", st, sv)
+	}
+	lastSeen := *sv.LastSeenAt
+
+	// ハイパーバイザに到達できなくても前回の状態を返す
+	fake.Err = errors.New("connection refused")
+	if err := r.ReconcileAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sv, st = status()
+	if st != "running" || !sv.LastSeenAt.Equal(lastSeen) {
+		t.Errorf("unexpected server: %s %+v", st, sv)
+	}
+}
+
+func TestReconcileLater(t *testing.T) {
+	db := newTestDB(t)
+	sv := model.Server{Model: model.Model{ID: 1}, Name: "vm1", HostName: "kvm1", OrganizationID: 1}
+	if err := db.Create(&sv).Error; err != nil {
+		t.Fatal(err)
+	}
+	fake := servertest.NewFakeExecutor()
+	fake.AddDomain("kvm1", "vm1", "running", 0)
+	hv := server.NewHypervisor(fake, server.Options{Timeouts: server.Timeouts{Status: time.Second}, Concurrency: 1, StoredState: true})
+	r := server.NewReconciler(db, hv, time.Minute)
+	if err := r.ReconcileAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := hv.ServerPowerOff(context.Background(), sv); err != nil {
+		t.Fatal(err)
+	}
+	r.ReconcileLater(sv, 50*time.Millisecond)
+
+	// 待ってから更新する
+	if err := db.First(&sv, 1).Error; err != nil || sv.State != "running" {
+		t.Fatalf("updated immediately: %+v %v", sv, err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for sv.State != "shut off" {
+		if time.Now().After(deadline) {
+			t.Fatalf("state = %q, want shut off", sv.State)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if err := db.First(&sv, 1).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
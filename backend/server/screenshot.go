@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/masa23/webapp-test/libvirt"
+	"github.com/masa23/webapp-test/model"
+)
+
+// サムネイルの最大サイズ
+const (
+	thumbnailWidth  = 320
+	thumbnailHeight = 240
+)
+
+// screenshotCache はサーバIDごとのサムネイルを短時間保持する
+type screenshotCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[uint64]screenshotEntry
+}
+
+type screenshotEntry struct {
+	png       []byte
+	expiresAt time.Time
+}
+
+func newScreenshotCache(ttl time.Duration) *screenshotCache {
+	return &screenshotCache{ttl: ttl, entries: make(map[uint64]screenshotEntry)}
+}
+
+func (c *screenshotCache) get(id uint64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(c.entries, id)
+		return nil, false
+	}
+	return e.png, true
+}
+
+func (c *screenshotCache) set(id uint64, png []byte) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// 期限切れのエントリを掃除する
+	now := time.Now()
+	for k, e := range c.entries {
+		if now.After(e.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[id] = screenshotEntry{png: png, expiresAt: now.Add(c.ttl)}
+}
+
+// ServerScreenshot は画面のサムネイルをPNGで返す
+// 取得した画像はキャッシュし、有効期間内はハイパーバイザに問い合わせない
+func (h *Hypervisor) ServerScreenshot(ctx context.Context, server model.Server) ([]byte, error) {
+	if data, ok := h.screenshotCache.get(server.ID); ok {
+		return data, nil
+	}
+
+	res, err := h.runWrapper(ctx, h.timeouts.Screenshot, server, "screenshot")
+	if err != nil {
+		log.Println("screenshot 実行失敗:", err)
+		return nil, err
+	}
+	if len(res.Data) == 0 {
+		return nil, errors.New("screenshot returned no image")
+	}
+
+	img, err := libvirt.DecodeScreenshot(res.Data)
+	if err != nil {
+		log.Println("screenshot 解析失敗:", err)
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, thumbnail(img, thumbnailWidth, thumbnailHeight)); err != nil {
+		return nil, err
+	}
+	h.screenshotCache.set(server.ID, buf.Bytes())
+	return buf.Bytes(), nil
+}
+
+// thumbnail は縦横比を保ったまま maxWidth x maxHeight に収まるよう縮小する
+// 縮小元の画素の平均をとるため文字が潰れにくい
+func thumbnail(src image.Image, maxWidth, maxHeight int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxWidth && h <= maxHeight {
+		return src
+	}
+	scale := min(float64(maxWidth)/float64(w), float64(maxHeight)/float64(h))
+	dw, dh := max(1, int(float64(w)*scale)), max(1, int(float64(h)*scale))
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			var r, g, bl, n uint32
+			for sy := sy0; sy < max(sy1, sy0+1); sy++ {
+				for sx := sx0; sx < max(sx1, sx0+1); sx++ {
+					cr, cg, cb, _ := src.At(sx, sy).RGBA()
+					r, g, bl, n = r+cr, g+cg, bl+cb, n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: 255,
+			})
+		}
+	}
+	return dst
+}
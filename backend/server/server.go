@@ -1,11 +1,12 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os/exec"
+	"net"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/masa23/webapp-test/libvirt"
 	"github.com/masa23/webapp-test/model"
@@ -13,102 +14,296 @@ import (
 )
 
 type ServersResponse struct {
-	Servers    []model.Server `json:"servers"`
-	TotalCount int64          `json:"total_count"`
-	Page       int            `json:"page"`
-	PageSize   int            `json:"page_size"`
+	Servers    []ServerWithStatus `json:"servers"`
+	TotalCount int64              `json:"total_count"`
+	Page       int                `json:"page"`
+	PageSize   int                `json:"page_size"`
+}
+
+// ServerWithStatus は一覧用にサーバ情報と電源状態をまとめたもの
+type ServerWithStatus struct {
+	model.Server
+	Status      string              `json:"status"`
+	Permissions []model.Permissions `json:"permissions,omitempty"` // 要求したユーザのこのサーバに対する権限
 }
 
 type ServerResponse struct {
-	Server model.Server `json:"server"`
-	Status string       `json:"status"`
+	Server      model.Server        `json:"server"`
+	Status      string              `json:"status"`
+	Permissions []model.Permissions `json:"permissions,omitempty"` // 要求したユーザのこのサーバに対する権限
+}
+
+// Timeouts はハイパーバイザ操作ごとのタイムアウト
+type Timeouts struct {
+	Status     time.Duration // dominfo
+	Power      time.Duration // start/shutdown/reboot/reset/destroy
+	Display    time.Duration // domdisplay
+	Screenshot time.Duration // screenshot
+}
+
+// Options はHypervisorの動作設定
+type Options struct {
+	Timeouts       Timeouts
+	Concurrency    int           // 状態取得を並行して行うホスト数
+	StatusCacheTTL time.Duration // 一覧で使う状態キャッシュの有効期間
+	// ScreenshotCacheTTL は画面のサムネイルのキャッシュの有効期間
+	ScreenshotCacheTTL time.Duration
+	// StoredState が true の場合、状態はReconcilerがDBに保存したものを返す
+	StoredState bool
+}
+
+// Hypervisor はExecutorを通してハイパーバイザ上のVMを操作する
+type Hypervisor struct {
+	exec     Executor
+	timeouts Timeouts
+
+	concurrency int
+	statusCache *statusCache
+	storedState bool
+
+	screenshotCache *screenshotCache
+}
+
+func NewHypervisor(exec Executor, opts Options) *Hypervisor {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+	return &Hypervisor{
+		exec:        exec,
+		timeouts:    opts.Timeouts,
+		concurrency: opts.Concurrency,
+		statusCache: newStatusCache(opts.StatusCacheTTL),
+		storedState: opts.StoredState,
+
+		screenshotCache: newScreenshotCache(opts.ScreenshotCacheTTL),
+	}
 }
 
-func GetServersByOrganizationIDAndSearch(db *gorm.DB, organizationID uint64, search string, page, pageSize int) (ServersResponse, error) {
+// GetServersByOrganizationIDAndSearch は組織のサーバ一覧を電源状態付きで返す
+// serverIDs が nil でない場合はそのサーバのみ、status が指定された場合はその状態のサーバのみを返す
+func (h *Hypervisor) GetServersByOrganizationIDAndSearch(ctx context.Context, db *gorm.DB, organizationID uint64, serverIDs []uint64, search, status string, page, pageSize int) (ServersResponse, error) {
 	var (
 		servers []model.Server
 		total   int64
 	)
 
-	query := db.Model(&model.Server{}).Where("organization_id = ?", organizationID)
+	query := db.WithContext(ctx).Model(&model.Server{}).Where("organization_id = ?", organizationID)
+	if serverIDs != nil {
+		if len(serverIDs) == 0 {
+			return ServersResponse{Servers: []ServerWithStatus{}, Page: page, PageSize: pageSize}, nil
+		}
+		query = query.Where("id IN ?", serverIDs)
+	}
 	if search != "" {
 		query = query.Where("name LIKE ?", "%"+search+"%")
 	}
 
+	offset := (page - 1) * pageSize
+
+	// 状態での絞り込みはDBでは出来ないので全件の状態を取得してからページングする
+	if status != "" {
+		if err := query.Find(&servers).Error; err != nil {
+			return ServersResponse{}, err
+		}
+		filtered := make([]ServerWithStatus, 0, len(servers))
+		for _, sv := range h.withStatuses(ctx, servers) {
+			if sv.Status == status {
+				filtered = append(filtered, sv)
+			}
+		}
+		total = int64(len(filtered))
+		if offset > len(filtered) {
+			offset = len(filtered)
+		}
+		end := min(offset+pageSize, len(filtered))
+		return ServersResponse{Servers: filtered[offset:end], TotalCount: total, Page: page, PageSize: pageSize}, nil
+	}
+
 	if err := query.Count(&total).Error; err != nil {
 		return ServersResponse{}, err
 	}
 
-	offset := (page - 1) * pageSize
 	if err := query.Offset(offset).Limit(pageSize).Find(&servers).Error; err != nil {
 		return ServersResponse{}, err
 	}
 
-	return ServersResponse{Servers: servers, TotalCount: total, Page: page, PageSize: pageSize}, nil
+	return ServersResponse{Servers: h.withStatuses(ctx, servers), TotalCount: total, Page: page, PageSize: pageSize}, nil
+}
+
+func (h *Hypervisor) withStatuses(ctx context.Context, servers []model.Server) []ServerWithStatus {
+	statuses := h.ServerStatuses(ctx, servers)
+	res := make([]ServerWithStatus, len(servers))
+	for i, sv := range servers {
+		res[i] = ServerWithStatus{Server: sv, Status: statuses[sv.ID]}
+	}
+	return res
 }
 
-func GetServerByID(db *gorm.DB, serverID uint64) (ServerResponse, error) {
-	var server model.Server
-	if err := db.First(&server, serverID).Error; err != nil {
-		return ServerResponse{}, err
+// run はタイムアウト付きでコマンドを実行する
+func (h *Hypervisor) run(ctx context.Context, timeout time.Duration, host, command string) ([]byte, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
+	return h.exec.Exec(ctx, host, command)
+}
 
-	status := getServerStatus(server)
-	return ServerResponse{Server: server, Status: status}, nil
+// ServerStatus はサーバの状態を返す
+// 保存された状態を使う場合以外は、ハイパーバイザから取得できなければエラーを返す
+func (h *Hypervisor) ServerStatus(ctx context.Context, server model.Server) (string, error) {
+	if h.storedState {
+		return storedStatus(server), nil
+	}
+	return h.fetchServerStatus(ctx, server)
 }
 
-func getServerStatus(server model.Server) string {
-	output, err := execSSH(server.HostName, "virsh-wrapper dominfo "+server.Name)
+// fetchServerStatus はハイパーバイザから状態を取得してキャッシュを更新する
+// 取得に失敗した場合は "unknown" とエラーを返す
+// 失敗はキャッシュせず、次の問い合わせで取得し直す
+func (h *Hypervisor) fetchServerStatus(ctx context.Context, server model.Server) (string, error) {
+	info, err := h.ServerDomInfo(ctx, server)
 	if err != nil {
-		log.Println("dominfo 実行失敗:", err)
-		return "unknown"
+		return "unknown", err
 	}
-	info, err := libvirt.ParseDomInfo(string(output))
+	h.statusCache.set(server.ID, info.State)
+	return info.State, nil
+}
+
+// ServerDomInfo はハイパーバイザからドメイン情報を取得する
+func (h *Hypervisor) ServerDomInfo(ctx context.Context, server model.Server) (libvirt.DomInfo, error) {
+	res, err := h.runWrapper(ctx, h.timeouts.Status, server, "dominfo")
 	if err != nil {
+		log.Println("dominfo 実行失敗:", err)
+		return libvirt.DomInfo{}, err
+	}
+	var info libvirt.DomInfo
+	if err := res.Decode(&info); err != nil {
 		log.Println("dominfo 解析失敗:", err)
-		return "unknown"
+		return libvirt.DomInfo{}, err
 	}
-	return info.State
+	return info, nil
 }
 
-func execSSH(host, command string) ([]byte, error) {
-	cmd := exec.Command("ssh", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null", "vmmgr@"+host, command)
-	return cmd.CombinedOutput()
+// runWrapper は virsh-wrapper を --json 付きで実行して結果を返す
+// virsh が失敗した場合は標準エラー出力の内容をエラーとして返す
+// 結果は標準出力のみから解析し、ラッパーの標準エラー出力は解析できない場合のエラーにのみ使う
+func (h *Hypervisor) runWrapper(ctx context.Context, timeout time.Duration, server model.Server, action string) (libvirt.Result, error) {
+	out, err := h.run(ctx, timeout, server.HostName, fmt.Sprintf("virsh-wrapper --json %s %s", action, server.Name))
+	res, perr := libvirt.ParseResult(out)
+	if perr != nil {
+		if err != nil {
+			return libvirt.Result{}, err
+		}
+		return libvirt.Result{}, perr
+	}
+	return res, res.Err()
 }
 
 // 汎用コマンド実行系
-func executeVMCommand(server model.Server, action string) error {
-	_, err := execSSH(server.HostName, fmt.Sprintf("virsh-wrapper %s %s", action, server.Name))
+func (h *Hypervisor) executeVMCommand(ctx context.Context, server model.Server, action string) error {
+	_, err := h.runWrapper(ctx, h.timeouts.Power, server, action)
+	// 状態が変わるのでキャッシュを破棄する
+	h.statusCache.delete(server.ID)
 	if err != nil {
 		log.Printf("%s 実行失敗: %v\n", action, err)
 	}
 	return err
 }
 
-func ServerPowerOn(server model.Server) error       { return executeVMCommand(server, "start") }
-func ServerPowerOff(server model.Server) error      { return executeVMCommand(server, "shutdown") }
-func ServerReboot(server model.Server) error        { return executeVMCommand(server, "reboot") }
-func ServerForceReboot(server model.Server) error   { return executeVMCommand(server, "reset") }
-func ServerForcePowerOff(server model.Server) error { return executeVMCommand(server, "destroy") }
+func (h *Hypervisor) ServerPowerOn(ctx context.Context, server model.Server) error {
+	return h.executeVMCommand(ctx, server, "start")
+}
+
+func (h *Hypervisor) ServerPowerOff(ctx context.Context, server model.Server) error {
+	return h.executeVMCommand(ctx, server, "shutdown")
+}
+
+func (h *Hypervisor) ServerReboot(ctx context.Context, server model.Server) error {
+	return h.executeVMCommand(ctx, server, "reboot")
+}
 
-func ServerDomDisplay(server model.Server) (int, error) {
-	out, err := execSSH(server.HostName, "virsh-wrapper domdisplay "+server.Name)
+func (h *Hypervisor) ServerForceReboot(ctx context.Context, server model.Server) error {
+	return h.executeVMCommand(ctx, server, "reset")
+}
+
+func (h *Hypervisor) ServerForcePowerOff(ctx context.Context, server model.Server) error {
+	return h.executeVMCommand(ctx, server, "destroy")
+}
+
+func (h *Hypervisor) serverDisplay(ctx context.Context, server model.Server) (libvirt.DomDisplay, error) {
+	res, err := h.runWrapper(ctx, h.timeouts.Display, server, "domdisplay")
 	if err != nil {
 		log.Println("domdisplay 実行失敗:", err)
-		return 0, err
+		return libvirt.DomDisplay{}, err
 	}
 
-	parts := strings.Split(strings.TrimSpace(string(out)), ":")
-	if len(parts) < 4 {
-		log.Println("出力形式エラー:", string(out))
-		return 0, fmt.Errorf("invalid domdisplay output")
+	var display libvirt.DomDisplay
+	if err := res.Decode(&display); err != nil {
+		log.Println("出力形式エラー:", err)
+		return libvirt.DomDisplay{}, err
 	}
+	if display.Type != "vnc" {
+		return libvirt.DomDisplay{}, fmt.Errorf("unsupported display type: %s", display.Type)
+	}
+
+	return display, nil
+}
 
-	port, err := strconv.Atoi(parts[3])
+// DialVNC はサーバのVNCに接続する
+// tunnel が true の場合はSSHで接続したハイパーバイザから、VNCの待ち受けアドレスに接続する
+// (VNCはハイパーバイザのlocalhostで待ち受けていればよい)
+// false の場合はバックエンドからハイパーバイザのVNCポートに直接接続する
+func (h *Hypervisor) DialVNC(ctx context.Context, server model.Server, tunnel bool) (net.Conn, error) {
+	display, err := h.serverDisplay(ctx, server)
 	if err != nil {
-		log.Println("ポート変換失敗:", err)
-		return 0, err
+		return nil, err
 	}
 
-	return port + 5900, nil
+	if h.timeouts.Display > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeouts.Display)
+		defer cancel()
+	}
+
+	if !tunnel {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", net.JoinHostPort(server.HostName, strconv.Itoa(display.Port)))
+	}
+
+	te, ok := h.exec.(TunnelExecutor)
+	if !ok {
+		return nil, ErrTunnelNotSupported
+	}
+	host := display.Host
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		// 0.0.0.0 や :: で待ち受けている場合はループバックに接続する
+		host = "127.0.0.1"
+	}
+	conn, err := te.Dial(ctx, server.HostName, net.JoinHostPort(host, strconv.Itoa(display.Port)))
+	if err != nil {
+		log.Println("VNCトンネル接続失敗:", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ServerConsole はシリアルコンソールに接続する
+// 接続にはVNCポート取得と同じタイムアウトを使う
+func (h *Hypervisor) ServerConsole(ctx context.Context, server model.Server, cols, rows int) (Stream, error) {
+	se, ok := h.exec.(StreamExecutor)
+	if !ok {
+		return nil, ErrStreamNotSupported
+	}
+	if h.timeouts.Display > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeouts.Display)
+		defer cancel()
+	}
+	stream, err := se.Stream(ctx, server.HostName, "virsh-wrapper console "+server.Name, cols, rows)
+	if err != nil {
+		log.Println("console 接続失敗:", err)
+		return nil, err
+	}
+	return stream, nil
 }
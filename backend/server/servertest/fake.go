@@ -0,0 +1,294 @@
+// Package servertest はテスト用のフェイクのハイパーバイザを提供する
+package servertest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/masa23/webapp-test/libvirt"
+	"github.com/masa23/webapp-test/server"
+)
+
+// FakeDomain はフェイクのハイパーバイザ上のドメイン
+type FakeDomain struct {
+	State   string
+	Display int // VNCディスプレイ番号
+}
+
+// FakeExecutor はテスト用のインメモリなハイパーバイザ
+// virsh-wrapper のコマンドを解釈してドメインの状態を変化させる
+type FakeExecutor struct {
+	mu      sync.Mutex
+	domains map[string]*FakeDomain
+	calls   []string
+	streams []*FakeStream
+	dials   []string
+
+	// Err が設定されている場合、全てのコマンドがこのエラーを返す
+	Err error
+	// Delay が設定されている場合、応答する前に待機する
+	Delay time.Duration
+}
+
+// NewFakeExecutor はドメインが登録されていないフェイクを返す
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{domains: make(map[string]*FakeDomain)}
+}
+
+func fakeKey(host, name string) string {
+	return host + "/" + name
+}
+
+// AddDomain はフェイクのドメインを登録する
+func (f *FakeExecutor) AddDomain(host, name, state string, display int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.domains[fakeKey(host, name)] = &FakeDomain{State: state, Display: display}
+}
+
+// Domain は登録済みドメインの状態のコピーを返す
+func (f *FakeExecutor) Domain(host, name string) (FakeDomain, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d, ok := f.domains[fakeKey(host, name)]
+	if !ok {
+		return FakeDomain{}, false
+	}
+	return *d, true
+}
+
+// Calls は実行されたコマンドの履歴を "host: command" の形式で返す
+func (f *FakeExecutor) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *FakeExecutor) Exec(ctx context.Context, host, command string) ([]byte, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, host+": "+command)
+	delay := f.Delay
+	f.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	args := strings.Fields(command)
+	jsonMode := len(args) > 1 && args[1] == "--json"
+	if jsonMode {
+		args = append(args[:1], args[2:]...)
+	}
+	if len(args) != 3 || args[0] != "virsh-wrapper" {
+		return nil, fmt.Errorf("unexpected command: %s", command)
+	}
+	action, name := args[1], args[2]
+
+	stdout, stderr, code := f.virsh(host, action, name)
+	if !jsonMode {
+		if code != 0 {
+			return []byte(stdout + stderr), fmt.Errorf("exit status %d", code)
+		}
+		return []byte(stdout), nil
+	}
+
+	// virsh-wrapper --json と同じ形式で返す
+	res := libvirt.Result{
+		Version:  libvirt.ResultVersion,
+		Command:  action,
+		Domain:   name,
+		ExitCode: code,
+		Stdout:   stdout,
+		Stderr:   stderr,
+	}
+	if code == 0 && action == "screenshot" {
+		res.Stdout = ""
+		res.Data = []byte(stdout)
+	}
+	if code == 0 {
+		var parsed any
+		switch action {
+		case "dominfo":
+			parsed, _ = libvirt.ParseDomInfo(stdout)
+		case "domdisplay":
+			parsed, _ = libvirt.ParseDomDisplay(stdout)
+		}
+		if parsed != nil {
+			res.Parsed, _ = json.Marshal(parsed)
+		}
+	}
+	out, err := json.Marshal(res)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return out, fmt.Errorf("exit status %d", code)
+	}
+	return out, nil
+}
+
+// virsh は virsh コマンドの動作を模倣して標準出力、標準エラー出力、終了コードを返す
+func (f *FakeExecutor) virsh(host, action, name string) (string, string, int) {
+	d, ok := f.domains[fakeKey(host, name)]
+	if !ok {
+		return "", "error: failed to get domain '" + name + "'\n", 1
+	}
+
+	switch action {
+	case "start":
+		if d.State == "running" {
+			return "", "error: Domain is already active\n", 1
+		}
+		d.State = "running"
+		return "Domain '" + name + "' started\n", "", 0
+	case "shutdown", "destroy":
+		if d.State != "running" {
+			return "", "error: domain is not running\n", 1
+		}
+		d.State = "shut off"
+	case "reboot", "reset":
+		if d.State != "running" {
+			return "", "error: domain is not running\n", 1
+		}
+	case "dominfo":
+		return fmt.Sprintf("Id:             1\nName:           %s\nState:          %s\nCPU(s):         1\nMax memory:     1048576 KiB\n", name, d.State), "", 0
+	case "domdisplay":
+		return fmt.Sprintf("vnc://127.0.0.1:%d\n", d.Display), "", 0
+	case "screenshot":
+		if d.State != "running" {
+			return "", "error: Requested operation is not valid: domain is not running\n", 1
+		}
+		// virsh-wrapper と同様に画像を標準出力に返す
+		return FakeScreenshot, "", 0
+	default:
+		return "", "error: unknown command: '" + action + "'\n", 1
+	}
+	return "", "", 0
+}
+
+// Stream は virsh-wrapper console を模倣し、書き込まれた内容をそのまま返す
+func (f *FakeExecutor) Stream(ctx context.Context, host, command string, cols, rows int) (server.Stream, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, host+": "+command)
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	args := strings.Fields(command)
+	if len(args) != 3 || args[0] != "virsh-wrapper" || args[1] != "console" {
+		return nil, fmt.Errorf("unexpected command: %s", command)
+	}
+	d, ok := f.domains[fakeKey(host, args[2])]
+	if !ok || d.State != "running" {
+		return nil, fmt.Errorf("domain is not running: %s", args[2])
+	}
+
+	r, w := io.Pipe()
+	s := &FakeStream{r: r, w: w}
+	s.resizes = append(s.resizes, [2]int{cols, rows})
+	f.streams = append(f.streams, s)
+	return s, nil
+}
+
+// Streams は開かれたストリームを返す
+func (f *FakeExecutor) Streams() []*FakeStream {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*FakeStream(nil), f.streams...)
+}
+
+// FakeStream は書き込まれた内容をそのまま読み出せるエコーストリーム
+type FakeStream struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+
+	mu      sync.Mutex
+	resizes [][2]int
+	closed  bool
+}
+
+func (s *FakeStream) Read(p []byte) (int, error)  { return s.r.Read(p) }
+func (s *FakeStream) Write(p []byte) (int, error) { return s.w.Write(p) }
+
+func (s *FakeStream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.w.Close()
+	return s.r.Close()
+}
+
+func (s *FakeStream) Resize(cols, rows int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.resizes = append(s.resizes, [2]int{cols, rows})
+	return nil
+}
+
+// Resizes は端末サイズの変更履歴を [cols, rows] の形式で返す
+func (s *FakeStream) Resizes() [][2]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][2]int(nil), s.resizes...)
+}
+
+// Closed はストリームが閉じられたかを返す
+func (s *FakeStream) Closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Dial はVNCサーバを模倣した接続を返す
+// 接続するとRFBのバージョンを送信し、以降は受け取った内容をそのまま返す
+func (f *FakeExecutor) Dial(ctx context.Context, host, addr string) (net.Conn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dials = append(f.dials, host+": "+addr)
+
+	if f.Err != nil {
+		return nil, f.Err
+	}
+
+	client, remote := net.Pipe()
+	go func() {
+		defer remote.Close()
+		if _, err := remote.Write([]byte(FakeRFBVersion)); err != nil {
+			return
+		}
+		io.Copy(remote, remote)
+	}()
+	return client, nil
+}
+
+// FakeScreenshot はフェイクの screenshot が返す 640x480 の黒一色のPPM画像
+var FakeScreenshot = "P6\n640 480\n255\n" + strings.Repeat("\x00", 640*480*3)
+
+// FakeRFBVersion はフェイクのVNCサーバが最初に送信するバージョン文字列
+const FakeRFBVersion = "RFB 003.008\n"
+
+// Dials は Dial で接続したアドレスの履歴を "host: addr" の形式で返す
+func (f *FakeExecutor) Dials() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.dials...)
+}
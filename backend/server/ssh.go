@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/masa23/webapp-test/model"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"gorm.io/gorm"
+)
+
+// SSHExecutor はGoのSSHクライアントでリモートホストのコマンドを実行する
+// 接続はホストごとに1本を保持して使い回す
+type SSHExecutor struct {
+	config *ssh.ClientConfig
+	port   int
+
+	// keepaliveInterval はプールした接続にkeepaliveを送る間隔
+	keepaliveInterval time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*ssh.Client
+}
+
+func NewSSHExecutor(user, privateKeyPath string, port int, hostKeyCallback ssh.HostKeyCallback) (*SSHExecutor, error) {
+	buf, err := os.ReadFile(privateKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	return &SSHExecutor{
+		config: &ssh.ClientConfig{
+			User:            user,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         10 * time.Second,
+		},
+		port:              port,
+		keepaliveInterval: 30 * time.Second,
+		clients:           make(map[string]*ssh.Client),
+	}, nil
+}
+
+func (e *SSHExecutor) Exec(ctx context.Context, host, command string) ([]byte, error) {
+	session, err := e.newSession(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		var stdout, stderr bytes.Buffer
+		session.Stdout = &stdout
+		session.Stderr = &stderr
+		if err := session.Run(command); err != nil {
+			done <- result{stdout.Bytes(), &ExecError{Err: err, Stderr: stderr.Bytes()}}
+			return
+		}
+		done <- result{stdout.Bytes(), nil}
+	}()
+
+	select {
+	case r := <-done:
+		return r.out, r.err
+	case <-ctx.Done():
+		// リモートのコマンドを止めてセッションを閉じる
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// newSession はプールされた接続で新しいセッションを開く
+func (e *SSHExecutor) newSession(ctx context.Context, host string) (*ssh.Session, error) {
+	client, err := e.client(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := e.openSession(ctx, host, client)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// 切断済みの接続を捨てて1度だけ再接続する
+		e.drop(host, client)
+		if client, err = e.client(ctx, host); err != nil {
+			return nil, err
+		}
+		if session, err = e.openSession(ctx, host, client); err != nil {
+			e.drop(host, client)
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// openSession はctxの期限内にセッションを開く
+// 応答しない接続は期限切れの時点で閉じてプールから外す
+func (e *SSHExecutor) openSession(ctx context.Context, host string, client *ssh.Client) (*ssh.Session, error) {
+	type result struct {
+		session *ssh.Session
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		session, err := client.NewSession()
+		done <- result{session, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.session, r.err
+	case <-ctx.Done():
+		e.drop(host, client)
+		go func() {
+			// 接続を閉じた後に開けたセッションがあれば閉じる
+			if r := <-done; r.session != nil {
+				r.session.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Stream はptyを割り当ててコマンドを開始する
+func (e *SSHExecutor) Stream(ctx context.Context, host, command string, cols, rows int) (Stream, error) {
+	session, err := e.newSession(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	modes := ssh.TerminalModes{
+		ssh.TTY_OP_ISPEED: 115200,
+		ssh.TTY_OP_OSPEED: 115200,
+	}
+	if err := session.RequestPty("xterm-256color", rows, cols, modes); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	if err := session.Start(command); err != nil {
+		session.Close()
+		return nil, err
+	}
+	return &sshStream{session: session, stdin: stdin, stdout: stdout}, nil
+}
+
+// Dial はSSHのdirect-tcpipチャネルでホストから見た addr に接続する
+func (e *SSHExecutor) Dial(ctx context.Context, host, addr string) (net.Conn, error) {
+	client, err := e.client(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := client.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+type sshStream struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	stdout  io.Reader
+}
+
+func (s *sshStream) Read(p []byte) (int, error)  { return s.stdout.Read(p) }
+func (s *sshStream) Write(p []byte) (int, error) { return s.stdin.Write(p) }
+
+func (s *sshStream) Close() error {
+	s.stdin.Close()
+	return s.session.Close()
+}
+
+func (s *sshStream) Resize(cols, rows int) error {
+	return s.session.WindowChange(rows, cols)
+}
+
+func (e *SSHExecutor) client(ctx context.Context, host string) (*ssh.Client, error) {
+	e.mu.Lock()
+	client, ok := e.clients[host]
+	e.mu.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := e.dial(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	// 並行して接続された場合は先に登録された方を使う
+	if c, ok := e.clients[host]; ok {
+		client.Close()
+		return c, nil
+	}
+	e.clients[host] = client
+	go e.keepalive(host, client)
+	return client, nil
+}
+
+// keepalive は定期的にkeepaliveを送り、応答しない接続をプールから外す
+func (e *SSHExecutor) keepalive(host string, client *ssh.Client) {
+	closed := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(closed)
+	}()
+
+	ticker := time.NewTicker(e.keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			e.drop(host, client)
+			return
+		case <-ticker.C:
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		timer := time.NewTimer(e.config.Timeout)
+		select {
+		case err := <-replied:
+			timer.Stop()
+			if err != nil {
+				e.drop(host, client)
+				return
+			}
+		case <-closed:
+			timer.Stop()
+			e.drop(host, client)
+			return
+		case <-timer.C:
+			log.Printf("%s へのSSH接続が応答しないため切断", host)
+			e.drop(host, client)
+			return
+		}
+	}
+}
+
+func (e *SSHExecutor) dial(ctx context.Context, host string) (*ssh.Client, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(e.port))
+	d := net.Dialer{Timeout: e.config.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	// ハンドシェイクもctxの期限内に終わらせる
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, e.config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (e *SSHExecutor) drop(host string, client *ssh.Client) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.clients[host] == client {
+		delete(e.clients, host)
+	}
+	client.Close()
+}
+
+// Close は保持している全ての接続を閉じる
+func (e *SSHExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for host, client := range e.clients {
+		client.Close()
+		delete(e.clients, host)
+	}
+	return nil
+}
+
+// NewHostKeyCallback はホスト鍵の検証を行うコールバックを返す
+// DBにホスト鍵が登録されている場合はそれのみを信頼し、
+// 登録がなければknown_hostsファイルで検証する
+func NewHostKeyCallback(db *gorm.DB, knownHostsPath string) (ssh.HostKeyCallback, error) {
+	var fileCallback ssh.HostKeyCallback
+	if knownHostsPath != "" {
+		cb, err := knownhosts.New(knownHostsPath)
+		if err != nil {
+			return nil, err
+		}
+		fileCallback = cb
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		host, _, err := net.SplitHostPort(hostname)
+		if err != nil {
+			host = hostname
+		}
+
+		var pinned []model.HostKey
+		if err := db.Where("host_name = ?", host).Find(&pinned).Error; err != nil {
+			return err
+		}
+		if len(pinned) > 0 {
+			for _, hk := range pinned {
+				pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hk.PublicKey))
+				if err != nil {
+					continue
+				}
+				if bytes.Equal(pk.Marshal(), key.Marshal()) {
+					return nil
+				}
+			}
+			return fmt.Errorf("host key mismatch for %s", host)
+		}
+
+		if fileCallback != nil {
+			return fileCallback(hostname, remote, key)
+		}
+		return errors.New("no known host key for " + host)
+	}, nil
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/masa23/webapp-test/model"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testSSHServer は exec リクエストに "ok: <command>" を返すだけのSSHサーバ
+// 標準エラー出力には "warning: <command>" を書き出す
+// hang を立てるとチャネルの開設にもリクエストにも応答しなくなる
+type testSSHServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	conns    atomic.Int32
+	hang     atomic.Bool
+}
+
+func newTestSSHServer(t *testing.T, clientKey ssh.PublicKey) *testSSHServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &testSSHServer{listener: l, hostKey: hostKey}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	s.conns.Add(1)
+	go func() {
+		for req := range reqs {
+			if !s.hang.Load() {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	var pending []ssh.NewChannel
+	for nc := range chans {
+		if s.hang.Load() {
+			pending = append(pending, nc) // 受け付けも拒否もしない
+			continue
+		}
+		ch, reqs, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range reqs {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				req.Reply(true, nil)
+				ch.Write([]byte("ok: " + payload.Command))
+				ch.Stderr().Write([]byte("warning: " + payload.Command))
+				ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{0}))
+				return
+			}
+		}()
+	}
+}
+
+func (s *testSSHServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file:"+t.Name()+"?mode=memory&cache=shared"), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := model.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func writeTestPrivateKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPub
+}
+
+func TestSSHExecutor(t *testing.T) {
+	keyPath, clientPub := writeTestPrivateKey(t)
+	srv := newTestSSHServer(t, clientPub)
+	db := newTestDB(t)
+
+	if err := db.Create(&model.HostKey{
+		HostName:  "127.0.0.1",
+		PublicKey: string(ssh.MarshalAuthorizedKey(srv.hostKey.PublicKey())),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cb, err := NewHostKeyCallback(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewSSHExecutor("vmmgr", keyPath, srv.port(), cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	for i := 0; i < 3; i++ {
+		out, err := e.Exec(context.Background(), "127.0.0.1", "virsh-wrapper dominfo vm1")
+		if err != nil {
+			t.Fatalf("Exec failed: %v", err)
+		}
+		// 標準エラー出力は含めない
+		if string(out) != "ok: virsh-wrapper dominfo vm1" {
+			t.Errorf("unexpected output: %q", out)
+		}
+	}
+
+	// 接続は使い回される
+	if n := srv.conns.Load(); n != 1 {
+		t.Errorf("connections = %d, want 1", n)
+	}
+}
+
+func newTestSSHExecutor(t *testing.T) (*SSHExecutor, *testSSHServer) {
+	t.Helper()
+	keyPath, clientPub := writeTestPrivateKey(t)
+	srv := newTestSSHServer(t, clientPub)
+	db := newTestDB(t)
+	if err := db.Create(&model.HostKey{
+		HostName:  "127.0.0.1",
+		PublicKey: string(ssh.MarshalAuthorizedKey(srv.hostKey.PublicKey())),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+	cb, err := NewHostKeyCallback(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewSSHExecutor("vmmgr", keyPath, srv.port(), cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e, srv
+}
+
+func (e *SSHExecutor) pooled(host string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, ok := e.clients[host]
+	return ok
+}
+
+func TestSSHExecutorSessionTimeout(t *testing.T) {
+	e, srv := newTestSSHExecutor(t)
+
+	if _, err := e.Exec(context.Background(), "127.0.0.1", "virsh-wrapper list"); err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+
+	// 接続は生きているがチャネルを開けないサーバ
+	srv.hang.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := e.Exec(ctx, "127.0.0.1", "virsh-wrapper list")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("err = %v, want DeadlineExceeded", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Exec took %v", d)
+	}
+	if e.pooled("127.0.0.1") {
+		t.Error("stalled connection is still pooled")
+	}
+
+	// 次の呼び出しは新しい接続を張る
+	srv.hang.Store(false)
+	if _, err := e.Exec(context.Background(), "127.0.0.1", "virsh-wrapper list"); err != nil {
+		t.Fatalf("Exec after reconnect failed: %v", err)
+	}
+	if n := srv.conns.Load(); n != 2 {
+		t.Errorf("connections = %d, want 2", n)
+	}
+}
+
+func TestSSHExecutorKeepalive(t *testing.T) {
+	e, srv := newTestSSHExecutor(t)
+	e.keepaliveInterval = 50 * time.Millisecond
+	e.config.Timeout = 200 * time.Millisecond
+
+	if _, err := e.Exec(context.Background(), "127.0.0.1", "virsh-wrapper list"); err != nil {
+		t.Fatalf("Exec failed: %v", err)
+	}
+
+	// 応答があるうちは接続を保持する
+	time.Sleep(200 * time.Millisecond)
+	if !e.pooled("127.0.0.1") {
+		t.Fatal("healthy connection was dropped")
+	}
+
+	srv.hang.Store(true)
+	deadline := time.Now().Add(2 * time.Second)
+	for e.pooled("127.0.0.1") {
+		if time.Now().After(deadline) {
+			t.Fatal("unresponsive connection was not dropped")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestSSHExecutorHostKeyMismatch(t *testing.T) {
+	keyPath, clientPub := writeTestPrivateKey(t)
+	srv := newTestSSHServer(t, clientPub)
+	db := newTestDB(t)
+
+	// 別の鍵を登録しておく
+	_, otherPub := writeTestPrivateKey(t)
+	if err := db.Create(&model.HostKey{
+		HostName:  "127.0.0.1",
+		PublicKey: string(ssh.MarshalAuthorizedKey(otherPub)),
+	}).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	cb, err := NewHostKeyCallback(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewSSHExecutor("vmmgr", keyPath, srv.port(), cb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if _, err := e.Exec(context.Background(), "127.0.0.1", "virsh-wrapper dominfo vm1"); err == nil {
+		t.Fatal("Exec succeeded with mismatched host key")
+	}
+	if n := srv.conns.Load(); n != 0 {
+		t.Errorf("connections = %d, want 0", n)
+	}
+}
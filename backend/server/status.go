@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/masa23/webapp-test/model"
+)
+
+// statusCache はサーバIDごとの電源状態を短時間保持する
+type statusCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[uint64]statusEntry
+}
+
+type statusEntry struct {
+	status    string
+	expiresAt time.Time
+}
+
+func newStatusCache(ttl time.Duration) *statusCache {
+	return &statusCache{ttl: ttl, entries: make(map[uint64]statusEntry)}
+}
+
+func (c *statusCache) get(id uint64) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[id]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(e.expiresAt) {
+		delete(c.entries, id)
+		return "", false
+	}
+	return e.status, true
+}
+
+func (c *statusCache) set(id uint64, status string) {
+	if c.ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = statusEntry{status: status, expiresAt: time.Now().Add(c.ttl)}
+}
+
+func (c *statusCache) delete(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// ServerStatuses は複数サーバの電源状態をサーバIDをキーにして返す
+// キャッシュにないものだけをハイパーバイザに問い合わせる
+func (h *Hypervisor) ServerStatuses(ctx context.Context, servers []model.Server) map[uint64]string {
+	result := make(map[uint64]string, len(servers))
+	var pending []model.Server
+	for _, sv := range servers {
+		if h.storedState {
+			result[sv.ID] = storedStatus(sv)
+			continue
+		}
+		if status, ok := h.statusCache.get(sv.ID); ok {
+			result[sv.ID] = status
+			continue
+		}
+		pending = append(pending, sv)
+	}
+
+	var mu sync.Mutex
+	h.forEachByHost(ctx, pending, func(sv model.Server, skip bool) error {
+		status := "unknown"
+		var err error
+		if !skip {
+			status, err = h.fetchServerStatus(ctx, sv)
+		}
+		mu.Lock()
+		result[sv.ID] = status
+		mu.Unlock()
+		return err
+	})
+
+	return result
+}
+
+// storedStatus はDBに保存された状態を返す
+// 一度も取得できていなければ "unknown" を返す
+func storedStatus(sv model.Server) string {
+	if sv.LastSeenAt == nil || sv.State == "" {
+		return "unknown"
+	}
+	return sv.State
+}
+
+// forEachByHost はサーバをホストごとにまとめ、ホスト単位で並行して fn を呼び出す
+// 同じホストのサーバは1つのワーカーが順番に処理する
+// fn がタイムアウトした場合、そのホストの残りのサーバは skip=true で呼び出される
+func (h *Hypervisor) forEachByHost(ctx context.Context, servers []model.Server, fn func(sv model.Server, skip bool) error) {
+	byHost := make(map[string][]model.Server)
+	for _, sv := range servers {
+		byHost[sv.HostName] = append(byHost[sv.HostName], sv)
+	}
+
+	hosts := make(chan []model.Server)
+	var wg sync.WaitGroup
+	for i := 0; i < min(h.concurrency, len(byHost)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for svs := range hosts {
+				timedOut := false
+				for _, sv := range svs {
+					// 応答しないホストの残りのサーバは問い合わせない
+					err := fn(sv, timedOut)
+					if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+						timedOut = true
+					}
+				}
+			}
+		}()
+	}
+	for _, svs := range byHost {
+		hosts <- svs
+	}
+	close(hosts)
+	wg.Wait()
+}
@@ -0,0 +1,35 @@
+package server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/masa23/webapp-test/model"
+	"github.com/masa23/webapp-test/server"
+	"github.com/masa23/webapp-test/server/servertest"
+)
+
+func TestServerStatusesCache(t *testing.T) {
+	fake := servertest.NewFakeExecutor()
+	fake.AddDomain("kvm1", "vm1", "running", 0)
+	hv := server.NewHypervisor(fake, server.Options{Concurrency: 1, StatusCacheTTL: time.Minute})
+	servers := []model.Server{{Model: model.Model{ID: 1}, Name: "vm1", HostName: "kvm1"}}
+
+	// 取得に失敗した場合は "unknown" を返すがキャッシュしない
+	fake.Err = errors.New("connection refused")
+	if got := hv.ServerStatuses(context.Background(), servers)[1]; got != "unknown" {
+		t.Errorf("status = %q, want unknown", got)
+	}
+	fake.Err = nil
+	if got := hv.ServerStatuses(context.Background(), servers)[1]; got != "running" {
+		t.Errorf("status = %q, want running", got)
+	}
+
+	// 取得できた状態はキャッシュされる
+	fake.Err = errors.New("connection refused")
+	if got := hv.ServerStatuses(context.Background(), servers)[1]; got != "running" {
+		t.Errorf("status = %q, want cached running", got)
+	}
+}
@@ -8,62 +8,163 @@ type AccessToken = {
   expires_at: number
 }
 
+type LoginChallenge = {
+  two_factor_required: boolean
+  enrollment_required: boolean
+  challenge: string
+  expires_at: number
+}
+
+type TOTPEnrollment = {
+  secret: string
+  uri: string // otpauth URI
+}
+
+type Organization = {
+  id: number
+  name: string
+  role: string
+  default: boolean
+}
+
 export const useAuth = defineStore('auth', () => {
   const router = useRouter()
   const accessToken = ref<AccessToken | null>(null)
   const username = ref<string | null>(null)
+  // 組織内の役割から決まる権限 (view, power, force-power, console, manage)
+  const permissions = ref<string[]>([])
+  // 所属する組織と操作対象の組織 (null の場合は既定の組織)
+  const organizations = ref<Organization[]>([])
+  const organizationId = ref<number | null>(null)
 
-  const login = async (usernameInput: string, passwordInput: string) => {
+  // 二段階認証が必要な場合はチャレンジを返す (完了した場合は null)
+  const login = async (usernameInput: string, passwordInput: string): Promise<LoginChallenge | null> => {
+    let res
     try {
-      const res = await axios.post('/auth/login', {
+      res = await axios.post('/auth/login', {
         username: usernameInput,
         password: passwordInput,
       })
-      await fetchAccessToken()
-      await fetchProfile()
-      router.push('/')
     } catch (error) {
       throw new Error('Login failed')
     }
+    if (res.data && res.data.two_factor_required) {
+      return res.data as LoginChallenge
+    }
+    await completeLogin()
+    return null
+  }
+
+  // 二段階認証のコードを確認する (完了後に completeLogin を呼ぶ)
+  // ログイン中に登録した場合は一度だけ表示するリカバリーコードを返す
+  const loginTwoFactor = async (challenge: string, code: string, recoveryCode = ''): Promise<string[]> => {
+    try {
+      const res = await axios.post('/auth/login/2fa', {
+        challenge,
+        code,
+        recovery_code: recoveryCode,
+      })
+      return res.data.recovery_codes || []
+    } catch (error) {
+      throw new Error('Invalid two-factor code')
+    }
+  }
+
+  // 組織で二段階認証が必須の場合にログイン中に認証アプリを登録する
+  const enrollTwoFactor = async (challenge: string): Promise<TOTPEnrollment> => {
+    const res = await axios.post('/auth/login/2fa/enroll', { challenge })
+    return res.data
   }
 
+  const completeLogin = async () => {
+    await fetchAccessToken()
+    await fetchOrganizations()
+    await fetchProfile()
+    router.push('/')
+  }
+
+  // リフレッシュの度にリフレッシュトークンが置き換わるため、同時に呼ばれた場合は1回だけリフレッシュする
+  let refreshing: Promise<void> | null = null
+
   const fetchAccessToken = async () => {
     if (
       !accessToken.value ||
       !accessToken.value.access_token ||
       new Date().getTime() > (accessToken.value.expires_at*1000 - 10 * 1000)
     ) {
-      try {
-        const res = await axios.get('/auth/refresh')
-        if (res.data && res.data.access_token) {
-          accessToken.value = {
-            access_token: res.data.access_token,
-            expires_at: res.data.expires_at,
-          }
+      if (!refreshing) {
+        refreshing = refreshAccessToken().finally(() => {
+          refreshing = null
+        })
+      }
+      await refreshing
+    }
+  }
+
+  // 他のタブが同時にリフレッシュした場合は 409 が返るため、置き換わったクッキーで1回だけやり直す
+  const refreshAccessToken = async (retry = true): Promise<void> => {
+    try {
+      const res = await axios.get('/auth/refresh')
+      if (res.data && res.data.access_token) {
+        accessToken.value = {
+          access_token: res.data.access_token,
+          expires_at: res.data.expires_at,
         }
-      } catch (error) {
-        console.error('Failed to fetch access token', error)
-        logout()
       }
+    } catch (error) {
+      if (retry && axios.isAxiosError(error) && error.response?.status === 409) {
+        await new Promise((resolve) => setTimeout(resolve, 500))
+        return refreshAccessToken(false)
+      }
+      console.error('Failed to fetch access token', error)
+      logout()
     }
   }
 
   const fetchProfile = async () => {
-    const t = await getToken()
     try {
       const res = await axios.get('/api/profile', {
-        headers: {
-          Authorization: `Bearer ${t}`,
-        },
+        headers: await apiHeaders(),
       })
       if (res.data && res.data.username) {
         username.value = res.data.username
+        permissions.value = res.data.permissions || []
       }
     } catch (error) {
       console.error('Failed to fetch profile', error)
     }
   }
 
+  const fetchOrganizations = async () => {
+    try {
+      const res = await axios.get('/api/orgs', {
+        headers: { Authorization: `Bearer ${await getToken()}` },
+      })
+      organizations.value = res.data || []
+    } catch (error) {
+      console.error('Failed to fetch organizations', error)
+    }
+  }
+
+  // 操作対象の組織を切り替えて、その組織での権限を取得し直す
+  const selectOrganization = async (id: number | null) => {
+    organizationId.value = id
+    await fetchProfile()
+  }
+
+  const can = (permission: string) => permissions.value.includes(permission)
+
+  // APIの呼び出しに付けるヘッダ (アクセストークンと操作対象の組織)
+  const apiHeaders = async () => {
+    const headers: Record<string, string> = {
+      Authorization: `Bearer ${await getToken()}`,
+    }
+    if (organizationId.value !== null) {
+      headers['X-Organization-ID'] = String(organizationId.value)
+    }
+    return headers
+  }
+
   const getToken = async () => {
     await fetchAccessToken()
     return accessToken.value?.access_token || null
@@ -76,13 +177,27 @@ export const useAuth = defineStore('auth', () => {
       console.error('Logout failed', error)
     }
     accessToken.value = null
+    permissions.value = []
+    organizations.value = []
+    organizationId.value = null
     router.push('/login')
   }
 
   return {
     username,
+    permissions,
+    organizations,
+    organizationId,
+    can,
     getToken,
+    apiHeaders,
+    fetchProfile,
+    fetchOrganizations,
+    selectOrganization,
     login,
+    loginTwoFactor,
+    enrollTwoFactor,
+    completeLogin,
     logout,
     fetchAccessToken,
   }